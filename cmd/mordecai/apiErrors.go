@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//              _
+//   __ _ _ __ (_)   ___ _ __ _ __ ___  _ __ ___
+//  / _` | '_ \| |  / _ \ '__| '__/ _ \| '__/ __|
+// | (_| | |_) | | |  __/ |  | | | (_) | |  \__ \
+//  \__,_| .__/|_|  \___|_|  |_|  \___/|_|  |___/
+//       |_|
+
+// apiErrorKind classifies why a request to the server failed, so callers can
+// decide whether to log in again, wait, split the request or give up
+type apiErrorKind int
+
+const (
+	// The server couldn't be reached or the connection dropped
+	apiErrorNetwork apiErrorKind = iota
+	// The token is missing, invalid or expired
+	apiErrorAuth
+	// Too many requests, see RetryAfter
+	apiErrorRateLimited
+	// The request body was larger than the server accepts
+	apiErrorPayloadTooLarge
+	// The server failed to handle a valid request
+	apiErrorServer
+	// The server rejected the request itself
+	apiErrorRejected
+)
+
+func (k apiErrorKind) String() string {
+	switch k {
+	case apiErrorNetwork:
+		return "network error"
+	case apiErrorAuth:
+		return "authentication failed"
+	case apiErrorRateLimited:
+		return "rate limited"
+	case apiErrorPayloadTooLarge:
+		return "request too large"
+	case apiErrorServer:
+		return "server error"
+	default:
+		return "request rejected"
+	}
+}
+
+// apiError is returned by serverRequest for every failed request
+type apiError struct {
+	Kind       apiErrorKind
+	StatusCode int
+	// Message is the server's error message, if it sent one
+	Message string
+	// RetryAfter is how long the server asked us to wait, if it did
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *apiError) Error() string {
+	msg := e.Kind.String()
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("%s (%d)", msg, e.StatusCode)
+	}
+	if e.Message != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Message)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// retryable reports whether the same request may succeed if sent again later
+func (e *apiError) retryable() bool {
+	switch e.Kind {
+	case apiErrorNetwork, apiErrorRateLimited, apiErrorServer:
+		return true
+	}
+	return false
+}
+
+// isAPIError reports whether err is an apiError of the given kind
+func isAPIError(err error, kind apiErrorKind) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Kind == kind
+}
+
+// isRetryable reports whether err is an apiError that may succeed later
+func isRetryable(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.retryable()
+}
+
+// retryAfter returns the delay the server asked for, if any
+func retryAfter(err error) time.Duration {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+	return 0
+}
+
+// errorKindForStatus maps an HTTP status code that isn't a success to the
+// kind of failure. A 403 is rejected rather than auth: the token is valid,
+// so logging in again won't help.
+func errorKindForStatus(statusCode int) apiErrorKind {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return apiErrorAuth
+	case statusCode == http.StatusTooManyRequests:
+		return apiErrorRateLimited
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return apiErrorPayloadTooLarge
+	case statusCode >= 500:
+		return apiErrorServer
+	default:
+		return apiErrorRejected
+	}
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// isAuthMessage reports whether an error message from the server means the
+// token needs replacing, for responses that don't use a 401 status
+func isAuthMessage(message string) bool {
+	return message == "No Access Token" || message == "Expired Token"
+}
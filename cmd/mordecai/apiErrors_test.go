@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerRequestErrors(t *testing.T) {
+	useToken(t, "token", nil)
+	tests := []struct {
+		name       string
+		status     int
+		header     map[string]string
+		body       string
+		kind       apiErrorKind
+		message    string
+		retryAfter time.Duration
+		retryable  bool
+	}{
+		{name: "Unauthorized", status: 401, body: `{"error":"Invalid token"}`, kind: apiErrorAuth, message: "Invalid token"},
+		{name: "Forbidden", status: 403, body: `{"error":"Not a member of this space"}`, kind: apiErrorRejected, message: "Not a member of this space"},
+		{name: "Expired token with forbidden status", status: 403, body: `{"error":"Expired Token"}`, kind: apiErrorAuth, message: "Expired Token"},
+		{name: "Expired token with success status", status: 200, body: `{"success":false,"error":"Expired Token"}`, kind: apiErrorAuth, message: "Expired Token"},
+		{name: "Rate limited", status: 429, header: map[string]string{"Retry-After": "7"}, kind: apiErrorRateLimited, retryAfter: 7 * time.Second, retryable: true},
+		{name: "Payload too large", status: 413, kind: apiErrorPayloadTooLarge},
+		{name: "HTML error page", status: 502, body: "<html>Bad Gateway</html>", kind: apiErrorServer, message: "Bad Gateway", retryable: true},
+		{name: "Rejected with message", status: 400, body: `{"error":"Unknown space"}`, kind: apiErrorRejected, message: "Unknown space"},
+		{name: "Error in success response", status: 200, body: `{"error":"Context is locked"}`, kind: apiErrorRejected, message: "Context is locked"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for key, value := range tt.header {
+					w.Header().Set(key, value)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := serverRequest[map[string]string](context.Background(), server.URL, map[string]string{})
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("serverRequest() error = %v, want an *apiError", err)
+			}
+			if apiErr.Kind != tt.kind {
+				t.Errorf("Kind = %v, want %v", apiErr.Kind, tt.kind)
+			}
+			if tt.message != "" && apiErr.Message != tt.message {
+				t.Errorf("Message = %q, want %q", apiErr.Message, tt.message)
+			}
+			if apiErr.RetryAfter != tt.retryAfter {
+				t.Errorf("RetryAfter = %v, want %v", apiErr.RetryAfter, tt.retryAfter)
+			}
+			if isRetryable(err) != tt.retryable {
+				t.Errorf("isRetryable() = %v, want %v", isRetryable(err), tt.retryable)
+			}
+		})
+	}
+}
+
+func TestServerRequestNetworkError(t *testing.T) {
+	useToken(t, "token", nil)
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	_, err := serverRequest[map[string]string](context.Background(), server.URL, map[string]string{})
+	if !isAPIError(err, apiErrorNetwork) || !isRetryable(err) {
+		t.Errorf("serverRequest() error = %v, want a retryable network error", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{header: "", expected: 0},
+		{header: "30", expected: 30 * time.Second},
+		{header: now.Add(time.Minute).Format(http.TimeFormat), expected: time.Minute},
+		{header: now.Add(-time.Minute).Format(http.TimeFormat), expected: 0},
+		{header: "soon", expected: 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.expected)
+		}
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
+	"html/template"
 	"net"
 	"net/http"
 	"net/url"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,54 +32,305 @@ import (
 //  \__,_|\__,_|\__|_| |_|\___|_| |_|\__|_|\___\__,_|\__|_|\___/|_| |_|
 //
 
-func authenticate() (string, error) {
-	authenticateUrl := fmt.Sprintf("https://%s", siteUrl)
-	token, err := loadToken()
+// loginTimeout is how long the browser login waits for the callback
+const loginTimeout = 2 * time.Minute
 
+// authenticate logs in through the browser and returns the new token, which
+// is also saved for later runs.
+//
+// The browser comes back to a server on 127.0.0.1 with a code, which is
+// exchanged for the token using a PKCE verifier only this process knows. A
+// random state ties the callback to this login, so other processes or pages
+// can't inject a token of their own.
+func authenticate(ctx context.Context) (string, error) {
+	authenticateUrl := webBaseURL()
+
+	state, err := randomString(32)
 	if err != nil {
-		return "", fmt.Errorf("failed to load token: %w", err)
+		return "", err
 	}
-
-	if len(token) > 0 {
-		// This is where you will ping the workspaces to see if the token is valid
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", err
 	}
 
-	// Find an available port
-	listener, err := net.Listen("tcp", ":0")
+	// Only this machine can reach the callback
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		return "", fmt.Errorf("failed to find an available port: %w", err)
 	}
 	port := listener.Addr().(*net.TCPAddr).Port
-	listener.Close()
 
-	authURL := fmt.Sprintf("%s/cli?port=%d", authenticateUrl, port)
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
 
-	// Start local server in a goroutine
-	tokenChan := make(chan string, 1)
-	errChan := make(chan error, 1)
-	go func() {
-		token, err := startLocalServer(port)
-		if err != nil {
-			errChan <- err
-		} else {
-			tokenChan <- token
-		}
+	results := make(chan callbackResult, 1)
+	exchange := func(code string) (string, error) {
+		return exchangeLoginCode(ctx, apiBaseURL(), code, verifier)
+	}
+	server := &http.Server{
+		Handler:           callbackHandler(state, exchange, results),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
 	}()
 
+	params := url.Values{}
+	params.Set("port", strconv.Itoa(port))
+	params.Set("state", state)
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+	authURL := fmt.Sprintf("%s/cli?%s", authenticateUrl, params.Encode())
+
 	// Open browser
-	if err := openBrowser(authURL); err != nil {
+	if err := openBrowser(ctx, authURL); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", fmt.Errorf("failed to open browser: %w", err)
 	}
 
 	// Wait for token or error with a timeout
 	select {
-	case token := <-tokenChan:
-		return token, nil
-	case err := <-errChan:
+	case result := <-results:
+		if result.err != nil {
+			return "", result.err
+		}
+		if err := saveToken(result.token); err != nil {
+			return "", err
+		}
+		return result.token, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("authentication timed out")
+		}
+		return "", ctx.Err()
+	}
+}
+
+// callbackResult is the outcome of the browser coming back to the
+// callback server
+type callbackResult struct {
+	token string
+	err   error
+}
+
+// callbackHandler serves /callback for one login. Requests without the
+// expected state are refused and don't end the login; the first request
+// with it delivers its result.
+func callbackHandler(state string, exchange func(code string) (string, error), results chan<- callbackResult) http.Handler {
+	var once sync.Once
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !hmac.Equal([]byte(query.Get("state")), []byte(state)) {
+			writeCallbackPage(w, http.StatusBadRequest, "This login link doesn't belong to the login mordecai started. Run the login again from your terminal.")
+			return
+		}
+
+		handled := false
+		once.Do(func() {
+			handled = true
+			var result callbackResult
+			switch {
+			case query.Get("error") != "":
+				result.err = fmt.Errorf("login failed: %s", query.Get("error"))
+			case query.Get("code") != "":
+				result.token, result.err = exchange(query.Get("code"))
+			default:
+				// A bare token can't be tied to the verifier, so it isn't accepted
+				result.err = fmt.Errorf("no login code received")
+			}
+			results <- result
+
+			if result.err != nil {
+				writeCallbackPage(w, http.StatusBadRequest, fmt.Sprintf("Login failed: %v. Run the login again from your terminal.", result.err))
+				return
+			}
+			writeCallbackPage(w, http.StatusOK, "")
+		})
+		if !handled {
+			writeCallbackPage(w, http.StatusConflict, "This login has already completed. You can close this tab.")
+		}
+	})
+	return mux
+}
+
+// exchangeLoginCode swaps the code from the callback for a token, proving
+// with verifier that this process started the login
+func exchangeLoginCode(ctx context.Context, apiBase, code, verifier string) (string, error) {
+	requestBody := struct {
+		Code         string `json:"code"`
+		CodeVerifier string `json:"codeVerifier"`
+	}{
+		Code:         code,
+		CodeVerifier: verifier,
+	}
+
+	response, err := postRequest[tokenResponse](ctx, apiBase+"/cli/token", "", requestBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange the login code: %w", err)
+	}
+	if response.Token == "" {
+		return "", fmt.Errorf("no token received")
+	}
+	return response.Token, nil
+}
+
+// randomString returns n random bytes, base64url encoded
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// pkceChallenge is the S256 code challenge for verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// callbackPage is shown in the browser when it comes back to mordecai. An
+// empty Error means the login worked.
+var callbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Mordecai</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; background: #f6f6f4; color: #222; }
+main { text-align: center; max-width: 28rem; }
+h1 { font-size: 1.5rem; }
+</style>
+</head>
+<body>
+<main>
+{{if .Error}}<h1>Login failed</h1>
+<p>{{.Error}}</p>
+{{else}}<h1>You're logged in</h1>
+<p>You can close this tab and return to your terminal, or <a href="{{.ChatURL}}">open Mordecai</a>.</p>
+{{end}}</main>
+</body>
+</html>
+`))
+
+func writeCallbackPage(w http.ResponseWriter, status int, errorMessage string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	callbackPage.Execute(w, struct {
+		Error   string
+		ChatURL string
+	}{
+		Error:   errorMessage,
+		ChatURL: webBaseURL() + "/chat",
+	})
+}
+
+// devicePollInterval is how often a device login checks for completion
+// when the server doesn't say
+var devicePollInterval = 5 * time.Second
+
+// deviceCode is the server's answer to a device login request
+type deviceCode struct {
+	DeviceCode      string `json:"deviceCode"`
+	UserCode        string `json:"userCode"`
+	VerificationURL string `json:"verificationUrl"`
+	// Seconds until the code expires and between polls
+	ExpiresIn int `json:"expiresIn"`
+	Interval  int `json:"interval"`
+}
+
+// tokenResponse is the server's answer when a login completes
+type tokenResponse struct {
+	Token string `json:"token"`
+}
+
+// authenticateDevice logs in by showing a code to enter in a browser on any
+// device, for machines with no browser or no port the browser can reach,
+// such as a VM over SSH. The new token is saved for later runs.
+func authenticateDevice(ctx context.Context) (string, error) {
+	token, err := deviceLogin(ctx, apiBaseURL())
+	if err != nil {
+		return "", err
+	}
+	if err := saveToken(token); err != nil {
 		return "", err
-	case <-time.After(2 * time.Minute):
-		return "", fmt.Errorf("authentication timed out")
 	}
+	return token, nil
+}
+
+// deviceLogin runs the device login against the API at apiBase and
+// returns the token once the code has been approved
+func deviceLogin(ctx context.Context, apiBase string) (string, error) {
+	code, err := postRequest[deviceCode](ctx, apiBase+"/cli/device/code", "", struct{}{})
+	if err != nil {
+		return "", fmt.Errorf("failed to start device login: %w", err)
+	}
+
+	fmt.Printf("To log in, open \033[1;36m%s\033[0m on any device and enter the code \033[1;33m%s\033[0m\n", code.VerificationURL, code.UserCode)
+
+	interval := devicePollInterval
+	if code.Interval > 0 {
+		interval = time.Duration(code.Interval) * time.Second
+	}
+	expiresIn := 10 * time.Minute
+	if code.ExpiresIn > 0 {
+		expiresIn = time.Duration(code.ExpiresIn) * time.Second
+	}
+	deadline := time.Now().Add(expiresIn)
+
+	requestBody := struct {
+		DeviceCode string `json:"deviceCode"`
+	}{
+		DeviceCode: code.DeviceCode,
+	}
+
+	var token string
+	err = showLoadingAnimation("Waiting for the code to be approved...", func() error {
+		for {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("the code expired, run 'mordecai login --device' to get a new one")
+			}
+
+			response, err := postRequest[tokenResponse](ctx, apiBase+"/cli/device/token", "", requestBody)
+
+			var apiErr *apiError
+			errors.As(err, &apiErr)
+			switch {
+			case err == nil && response.Token != "":
+				token = response.Token
+				return nil
+			case err == nil:
+				return fmt.Errorf("the server approved the login without sending a token")
+			case apiErr != nil && apiErr.Message == "authorization_pending":
+			case apiErr != nil && apiErr.Message == "slow_down":
+				interval += devicePollInterval
+			case apiErr != nil && apiErr.Message == "access_denied":
+				return fmt.Errorf("the login was denied")
+			case apiErr != nil && apiErr.Message == "expired_token":
+				return fmt.Errorf("the code expired, run 'mordecai login --device' to get a new one")
+			case isRetryable(err):
+				// Keep polling through network blips until the code expires
+			default:
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
 }
 
 type model struct {
@@ -103,16 +363,22 @@ func (m model) View() string {
 	return fmt.Sprintf("Open url: **%s** to authenticate? (y/n): ", m.url)
 }
 
-func openBrowser(url string) error {
+func openBrowser(ctx context.Context, url string) error {
+	if !isInteractive() {
+		return fmt.Errorf("no terminal to log in from, set MORDECAI_TOKEN instead")
+	}
 
-	p := tea.NewProgram(model{url: url})
-	m, err := p.Run()
-	if err != nil {
-		return fmt.Errorf("Bubbletea error: %w", err)
+	choice := "y"
+	if !assumeYes {
+		p := tea.NewProgram(model{url: url}, tea.WithContext(ctx))
+		m, err := p.Run()
+		if err != nil {
+			return fmt.Errorf("Bubbletea error: %w", err)
+		}
+		choice = m.(model).choice
 	}
 
-	finalModel := m.(model)
-	if finalModel.choice == "y" {
+	if choice == "y" {
 		var cmd *exec.Cmd
 		switch runtime.GOOS {
 		case "darwin":
@@ -126,40 +392,3 @@ func openBrowser(url string) error {
 	}
 	return fmt.Errorf("user declined to open browser")
 }
-
-func startLocalServer(callbackPort int) (string, error) {
-	tokenChan := make(chan string, 1)
-	errChan := make(chan error, 1)
-	redirectUrl := fmt.Sprintf("https://%s/chat", siteUrl)
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		parsedURL, err := url.Parse(r.URL.String())
-		if err != nil {
-			errChan <- fmt.Errorf("failed to parse URL: %w", err)
-			return
-		}
-
-		token := parsedURL.Query().Get("token")
-		if token != "" {
-			saveToken(token)
-			tokenChan <- token
-
-			// Immediate redirect
-			http.Redirect(w, r, redirectUrl, http.StatusSeeOther)
-		} else {
-			errChan <- fmt.Errorf("no token received")
-		}
-	})
-
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", callbackPort), nil); err != nil {
-			errChan <- fmt.Errorf("server error: %w", err)
-		}
-	}()
-
-	select {
-	case token := <-tokenChan:
-		return token, nil
-	case err := <-errChan:
-		return "", err
-	}
-}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	defer func(previous time.Duration) { devicePollInterval = previous }(devicePollInterval)
+	devicePollInterval = 10 * time.Millisecond
+
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("device login sent an Authorization header to %s", r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/cli/device/code":
+			json.NewEncoder(w).Encode(deviceCode{DeviceCode: "device-1", UserCode: "ABCD-EFGH", VerificationURL: "https://example.com/device", ExpiresIn: 60})
+		case "/cli/device/token":
+			var body struct {
+				DeviceCode string `json:"deviceCode"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.DeviceCode != "device-1" {
+				t.Errorf("polled with device code %q, want device-1", body.DeviceCode)
+			}
+
+			polls++
+			switch polls {
+			case 1:
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+			case 2:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				json.NewEncoder(w).Encode(tokenResponse{Token: "device-token"})
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	token, err := deviceLogin(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("deviceLogin() error = %v", err)
+	}
+	if token != "device-token" || polls != 3 {
+		t.Errorf("deviceLogin() = %q after %d polls, want device-token after 3", token, polls)
+	}
+}
+
+func TestDeviceLoginDenied(t *testing.T) {
+	defer func(previous time.Duration) { devicePollInterval = previous }(devicePollInterval)
+	devicePollInterval = 10 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cli/device/code" {
+			json.NewEncoder(w).Encode(deviceCode{DeviceCode: "device-1", UserCode: "ABCD-EFGH"})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "access_denied"})
+	}))
+	defer server.Close()
+
+	if _, err := deviceLogin(context.Background(), server.URL); err == nil {
+		t.Error("deviceLogin() should fail when the login is denied")
+	}
+}
+
+func TestCallbackHandler(t *testing.T) {
+	results := make(chan callbackResult, 1)
+	exchange := func(code string) (string, error) {
+		if code != "code-1" {
+			return "", fmt.Errorf("unknown code %q", code)
+		}
+		return "token-1", nil
+	}
+	server := httptest.NewServer(callbackHandler("state-1", exchange, results))
+	defer server.Close()
+
+	get := func(query string) int {
+		resp, err := http.Get(server.URL + "/callback?" + query)
+		if err != nil {
+			t.Fatalf("callback request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+			t.Errorf("callback Content-Type = %q, want an HTML page", contentType)
+		}
+		return resp.StatusCode
+	}
+
+	// A token injected without the state is refused and doesn't end the login
+	if status := get("token=injected"); status != http.StatusBadRequest {
+		t.Errorf("callback without state = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := get("state=wrong&token=injected"); status != http.StatusBadRequest {
+		t.Errorf("callback with the wrong state = %d, want %d", status, http.StatusBadRequest)
+	}
+	select {
+	case result := <-results:
+		t.Fatalf("callback with a bad state delivered %+v", result)
+	default:
+	}
+
+	if status := get("state=state-1&code=code-1"); status != http.StatusOK {
+		t.Errorf("callback = %d, want %d", status, http.StatusOK)
+	}
+	if result := <-results; result.err != nil || result.token != "token-1" {
+		t.Errorf("callback result = %+v, want token-1", result)
+	}
+
+	// Only the first callback counts
+	if status := get("state=state-1&code=code-1"); status != http.StatusConflict {
+		t.Errorf("second callback = %d, want %d", status, http.StatusConflict)
+	}
+
+	// Even with the state, a token has to come from exchanging a code
+	server = httptest.NewServer(callbackHandler("state-2", exchange, results))
+	defer server.Close()
+	if status := get("state=state-2&token=injected"); status != http.StatusBadRequest {
+		t.Errorf("callback with a bare token = %d, want %d", status, http.StatusBadRequest)
+	}
+	if result := <-results; result.err == nil || result.token != "" {
+		t.Errorf("callback result = %+v, want an error and no token", result)
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// Example from RFC 7636, appendix B
+	challenge := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("pkceChallenge() = %q, want the RFC 7636 example challenge", challenge)
+	}
+}
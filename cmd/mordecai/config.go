@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//                   __ _
+//   ___ ___  _ __  / _(_) __ _
+//  / __/ _ \| '_ \| |_| |/ _` |
+// | (_| (_) | | | |  _| | (_| |
+//  \___\___/|_| |_|_| |_|\__, |
+//                        |___/
+
+const (
+	userConfigFileName = "config.json"
+	repoConfigFileName = ".mordecai.json"
+
+	caBundleEnvVar = "MORDECAI_CA_BUNDLE"
+)
+
+// Config is the effective configuration, built from the defaults, the
+// per-user config in ~/.mordecai/config.json and the per-repository
+// .mordecai.json, with later files taking priority
+type Config struct {
+	fileTypes *fileTypeSet
+
+	// Files larger than maxFileBytes are never sent, and a single request
+	// carries at most maxBatchBytes of file content
+	maxFileBytes  int64
+	maxBatchBytes int64
+
+	// How files that look like they contain credentials are handled
+	secretAction        string
+	secretAllowPaths    []string
+	secretAllowPatterns []string
+
+	// How long to wait for a connection to the server, and for a whole
+	// request including its upload and response
+	connectTimeout time.Duration
+	requestTimeout time.Duration
+
+	// How the watcher batches changes: a batch is sent once no file has
+	// changed for the quiet period, once its oldest change has waited
+	// maxWait, or straight away when it reaches maxFiles or maxBytes. Zero
+	// limits mean no limit.
+	watchQuietPeriod time.Duration
+	watchMaxWait     time.Duration
+	watchMaxFiles    int
+	watchMaxBytes    int64
+
+	// How changes are found, auto or poll, and how often directories are
+	// listed when polling
+	watchMode         string
+	watchPollInterval time.Duration
+
+	// Whether a branch switch or rebase is followed by one resync of the
+	// working tree, and whether uploads say which branch and commit they
+	// come from
+	gitFollowBranches bool
+	gitTagContext     bool
+
+	// Where the API and website are, if not on the site of the profile
+	apiURL string
+	webURL string
+
+	// Certificates trusted on top of the system ones, and the proxy to
+	// use instead of the one from HTTPS_PROXY
+	caBundle string
+	rootCAs  *x509.CertPool
+	proxy    *url.URL
+
+	// Config files that were found and applied, in order
+	sources []string
+}
+
+// configFile is the on-disk format of both config files
+type configFile struct {
+	FileTypes fileTypesConfig `json:"fileTypes"`
+	Limits    limitsConfig    `json:"limits"`
+	Secrets   secretsConfig   `json:"secrets"`
+	Network   networkConfig   `json:"network"`
+	Server    serverConfig    `json:"server"`
+	Watch     watchConfig     `json:"watch"`
+	Git       gitConfig       `json:"git"`
+}
+
+// fileTypesConfig adds to or removes from the supported file types. Entries
+// starting with a dot are extensions, anything else is an exact file name
+// such as Dockerfile.
+type fileTypesConfig struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// limitsConfig caps how much is uploaded, in bytes. Zero keeps the default.
+type limitsConfig struct {
+	MaxFileBytes  int64 `json:"maxFileBytes"`
+	MaxBatchBytes int64 `json:"maxBatchBytes"`
+}
+
+// secretsConfig controls the scan for credentials before upload. Action is
+// block, redact or warn; allowPaths are gitignore-style patterns of files
+// that are never scanned and allowPatterns are regular expressions of
+// values that are never reported, such as documented example keys.
+type secretsConfig struct {
+	Action        string   `json:"action"`
+	AllowPaths    []string `json:"allowPaths"`
+	AllowPatterns []string `json:"allowPatterns"`
+}
+
+// networkConfig holds timeouts as Go durations such as "10s" or "2m", the
+// path of a PEM file of extra CA certificates and the URL of an HTTP(S)
+// proxy. An empty value keeps the default.
+type networkConfig struct {
+	ConnectTimeout string `json:"connectTimeout"`
+	RequestTimeout string `json:"requestTimeout"`
+	CABundle       string `json:"caBundle"`
+	Proxy          string `json:"proxy"`
+}
+
+// watchConfig holds the batching of watcher changes. Durations use Go
+// syntax such as "500ms" or "1m"; an empty or zero value keeps the default.
+type watchConfig struct {
+	QuietPeriod string `json:"quietPeriod"`
+	MaxWait     string `json:"maxWait"`
+	MaxFiles    int    `json:"maxFiles"`
+	MaxBytes    int64  `json:"maxBytes"`
+
+	Mode         string `json:"mode"`
+	PollInterval string `json:"pollInterval"`
+}
+
+// gitConfig controls how mordecai follows the git repository it syncs.
+// Both settings are on unless set to false.
+type gitConfig struct {
+	FollowBranches *bool `json:"followBranches"`
+	TagContext     *bool `json:"tagContext"`
+}
+
+// serverConfig points mordecai at another deployment, such as staging or
+// a self-hosted server. An empty value keeps the default.
+type serverConfig struct {
+	APIURL string `json:"apiUrl"`
+	WebURL string `json:"webUrl"`
+}
+
+const (
+	defaultMaxFileBytes  = 1 << 20
+	defaultMaxBatchBytes = 10 << 20
+
+	defaultConnectTimeout = 10 * time.Second
+	defaultRequestTimeout = 2 * time.Minute
+
+	defaultWatchQuietPeriod = 5 * time.Second
+	defaultWatchMaxWait     = 30 * time.Second
+
+	defaultWatchPollInterval = 2 * time.Second
+)
+
+// config is the configuration in effect for this run
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		fileTypes:     newFileTypeSet(supportedFileTypes),
+		maxFileBytes:  defaultMaxFileBytes,
+		maxBatchBytes: defaultMaxBatchBytes,
+		secretAction:  secretActionBlock,
+
+		connectTimeout: defaultConnectTimeout,
+		requestTimeout: defaultRequestTimeout,
+
+		watchQuietPeriod: defaultWatchQuietPeriod,
+		watchMaxWait:     defaultWatchMaxWait,
+
+		watchMode:         watchModeAuto,
+		watchPollInterval: defaultWatchPollInterval,
+
+		gitFollowBranches: true,
+		gitTagContext:     true,
+	}
+}
+
+// loadConfig reads the per-user config and the config of the repository
+// in repoDir on top of the defaults
+func loadConfig(repoDir string) (*Config, error) {
+	cfg := defaultConfig()
+
+	var paths []string
+	if mordecaiPath, err := getMordecaiDir(); err == nil {
+		paths = append(paths, filepath.Join(mordecaiPath, userConfigFileName))
+	}
+	repoConfigPath := ""
+	if repoDir != "" {
+		repoConfigPath = filepath.Join(repoDir, repoConfigFileName)
+		paths = append(paths, repoConfigPath)
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading config %s: %v", path, err)
+		}
+
+		var layer configFile
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+		switch layer.Secrets.Action {
+		case "", secretActionBlock, secretActionRedact, secretActionWarn:
+		default:
+			return nil, fmt.Errorf("error parsing config %s: secrets action must be block, redact or warn", path)
+		}
+		switch layer.Watch.Mode {
+		case "", watchModeAuto, watchModePoll:
+		default:
+			return nil, fmt.Errorf("error parsing config %s: watch mode must be auto or poll", path)
+		}
+		for _, pattern := range layer.Secrets.AllowPatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("error parsing config %s: invalid secrets allowPatterns entry %q: %v", path, pattern, err)
+			}
+		}
+		if cfg.connectTimeout, err = parseTimeout("network connectTimeout", layer.Network.ConnectTimeout, cfg.connectTimeout); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+		if cfg.requestTimeout, err = parseTimeout("network requestTimeout", layer.Network.RequestTimeout, cfg.requestTimeout); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+		if cfg.watchQuietPeriod, err = parseTimeout("watch quietPeriod", layer.Watch.QuietPeriod, cfg.watchQuietPeriod); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+		if cfg.watchMaxWait, err = parseTimeout("watch maxWait", layer.Watch.MaxWait, cfg.watchMaxWait); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+		if cfg.watchPollInterval, err = parseTimeout("watch pollInterval", layer.Watch.PollInterval, cfg.watchPollInterval); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+		// A repository could otherwise send the token to a server of its
+		// choosing
+		if path == repoConfigPath && (layer.Server != serverConfig{} || layer.Network.CABundle != "" || layer.Network.Proxy != "") {
+			return nil, fmt.Errorf("error parsing config %s: server, network.caBundle and network.proxy can only be set in ~/.mordecai/%s", path, userConfigFileName)
+		}
+		if err := cfg.applyServer(layer); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+		cfg.apply(layer)
+		cfg.sources = append(cfg.sources, path)
+	}
+
+	if caBundle := os.Getenv(caBundleEnvVar); caBundle != "" {
+		cfg.caBundle = caBundle
+	}
+	if cfg.caBundle != "" {
+		rootCAs, err := loadCABundle(cfg.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		cfg.rootCAs = rootCAs
+	}
+
+	return cfg, nil
+}
+
+// applyServer checks and applies the server URLs and connection settings
+// of layer
+func (c *Config) applyServer(layer configFile) error {
+	if err := validateBaseURL("server apiUrl", layer.Server.APIURL); err != nil {
+		return err
+	}
+	if err := validateBaseURL("server webUrl", layer.Server.WebURL); err != nil {
+		return err
+	}
+	if layer.Server.APIURL != "" {
+		c.apiURL = layer.Server.APIURL
+	}
+	if layer.Server.WebURL != "" {
+		c.webURL = layer.Server.WebURL
+	}
+
+	if layer.Network.CABundle != "" {
+		c.caBundle = layer.Network.CABundle
+	}
+	if layer.Network.Proxy != "" {
+		proxy, err := url.Parse(layer.Network.Proxy)
+		if err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5") || proxy.Host == "" {
+			return fmt.Errorf("network proxy must be a URL such as http://proxy.example.com:8080")
+		}
+		c.proxy = proxy
+	}
+	return nil
+}
+
+// loadCABundle returns the system certificates with the PEM certificates
+// in path added, for servers signed by a private CA
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %v", err)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("error reading CA bundle %s: no PEM certificates found", path)
+	}
+	return rootCAs, nil
+}
+
+func (c *Config) apply(layer configFile) {
+	for _, entry := range layer.FileTypes.Add {
+		c.fileTypes.add(entry)
+	}
+	for _, entry := range layer.FileTypes.Remove {
+		c.fileTypes.remove(entry)
+	}
+
+	if layer.Limits.MaxFileBytes > 0 {
+		c.maxFileBytes = layer.Limits.MaxFileBytes
+	}
+	if layer.Limits.MaxBatchBytes > 0 {
+		c.maxBatchBytes = layer.Limits.MaxBatchBytes
+	}
+	if layer.Watch.MaxFiles > 0 {
+		c.watchMaxFiles = layer.Watch.MaxFiles
+	}
+	if layer.Watch.MaxBytes > 0 {
+		c.watchMaxBytes = layer.Watch.MaxBytes
+	}
+	if layer.Watch.Mode != "" {
+		c.watchMode = layer.Watch.Mode
+	}
+
+	if layer.Git.FollowBranches != nil {
+		c.gitFollowBranches = *layer.Git.FollowBranches
+	}
+	if layer.Git.TagContext != nil {
+		c.gitTagContext = *layer.Git.TagContext
+	}
+
+	if layer.Secrets.Action != "" {
+		c.secretAction = layer.Secrets.Action
+	}
+	c.secretAllowPaths = append(c.secretAllowPaths, layer.Secrets.AllowPaths...)
+	c.secretAllowPatterns = append(c.secretAllowPatterns, layer.Secrets.AllowPatterns...)
+}
+
+// parseTimeout reads a duration setting, keeping current if it is empty
+func parseTimeout(name, value string, current time.Duration) (time.Duration, error) {
+	if value == "" {
+		return current, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as \"30s\"", name)
+	}
+	return timeout, nil
+}
+
+// fileTypeSet is the set of files mordecai syncs, by extension or by exact
+// file name
+type fileTypeSet struct {
+	extensions map[string]bool
+	filenames  map[string]bool
+}
+
+func newFileTypeSet(entries []string) *fileTypeSet {
+	set := &fileTypeSet{
+		extensions: make(map[string]bool),
+		filenames:  make(map[string]bool),
+	}
+	for _, entry := range entries {
+		set.add(entry)
+	}
+	return set
+}
+
+func (s *fileTypeSet) add(entry string) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return
+	}
+	if strings.HasPrefix(entry, ".") {
+		s.extensions[entry] = true
+	} else {
+		s.filenames[entry] = true
+	}
+}
+
+func (s *fileTypeSet) remove(entry string) {
+	entry = strings.TrimSpace(entry)
+	delete(s.extensions, entry)
+	delete(s.filenames, entry)
+}
+
+// matches reports whether the file at path is a supported file type
+func (s *fileTypeSet) matches(path string) bool {
+	name := filepath.Base(path)
+	if s.filenames[name] {
+		return true
+	}
+	ext := filepath.Ext(name)
+	return ext != "" && s.extensions[ext]
+}
+
+func (s *fileTypeSet) sortedExtensions() []string {
+	return sortedKeys(s.extensions)
+}
+
+func (s *fileTypeSet) sortedFilenames() []string {
+	return sortedKeys(s.filenames)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFileTypes(t *testing.T) {
+	homeDir := t.TempDir()
+	t.Setenv("HOME", homeDir)
+	repoDir := t.TempDir()
+
+	userConfig := `{"fileTypes": {"add": [".java", ".kt", "Dockerfile"]}}`
+	if err := os.MkdirAll(filepath.Join(homeDir, ".mordecai"), 0700); err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(homeDir, ".mordecai", userConfigFileName), []byte(userConfig), 0600); err != nil {
+		t.Fatalf("Failed to write user config: %v", err)
+	}
+
+	repoConfig := `{"fileTypes": {"add": ["Makefile"], "remove": [".kt", ".md"]}}`
+	if err := os.WriteFile(filepath.Join(repoDir, repoConfigFileName), []byte(repoConfig), 0600); err != nil {
+		t.Fatalf("Failed to write repo config: %v", err)
+	}
+
+	cfg, err := loadConfig(repoDir)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if len(cfg.sources) != 2 {
+		t.Errorf("loadConfig() sources = %v, want 2 files", cfg.sources)
+	}
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"src/Main.java", true},
+		{"src/Main.kt", false},
+		{"README.md", false},
+		{"main.go", true},
+		{"deploy/Dockerfile", true},
+		{"Makefile", true},
+		{"notes.txt", false},
+		{"Dockerfile.dev", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if result := cfg.fileTypes.matches(tt.path); result != tt.expected {
+				t.Errorf("matches(%v) = %v, want %v", tt.path, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	repoDir := t.TempDir()
+
+	for _, invalid := range []string{"{not json", `{"secrets": {"allowPatterns": ["EXAMPLE("]}}`} {
+		if err := os.WriteFile(filepath.Join(repoDir, repoConfigFileName), []byte(invalid), 0600); err != nil {
+			t.Fatalf("Failed to write repo config: %v", err)
+		}
+		if _, err := loadConfig(repoDir); err == nil {
+			t.Errorf("loadConfig() should fail on %s", invalid)
+		}
+	}
+}
+
+func TestLoadConfigNetwork(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	repoDir := t.TempDir()
+
+	repoConfig := `{"network": {"connectTimeout": "3s"}}`
+	if err := os.WriteFile(filepath.Join(repoDir, repoConfigFileName), []byte(repoConfig), 0600); err != nil {
+		t.Fatalf("Failed to write repo config: %v", err)
+	}
+
+	cfg, err := loadConfig(repoDir)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if cfg.connectTimeout != 3*time.Second || cfg.requestTimeout != defaultRequestTimeout {
+		t.Errorf("loadConfig() timeouts = %v, %v, want 3s and the default", cfg.connectTimeout, cfg.requestTimeout)
+	}
+
+	repoConfig = `{"network": {"requestTimeout": "soon"}}`
+	if err := os.WriteFile(filepath.Join(repoDir, repoConfigFileName), []byte(repoConfig), 0600); err != nil {
+		t.Fatalf("Failed to write repo config: %v", err)
+	}
+	if _, err := loadConfig(repoDir); err == nil {
+		t.Error("loadConfig() should fail on an invalid timeout")
+	}
+}
+
+func TestLoadConfigServer(t *testing.T) {
+	homeDir := t.TempDir()
+	t.Setenv("HOME", homeDir)
+	t.Setenv(caBundleEnvVar, "")
+	repoDir := t.TempDir()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caPath := filepath.Join(homeDir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+
+	userConfig := fmt.Sprintf(`{
+		"server": {"apiUrl": "https://api.staging.example.com"},
+		"network": {"caBundle": %q, "proxy": "http://proxy.example.com:3128"}
+	}`, caPath)
+	if err := os.MkdirAll(filepath.Join(homeDir, ".mordecai"), 0755); err != nil {
+		t.Fatalf("Failed to create config dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(homeDir, ".mordecai", userConfigFileName), []byte(userConfig), 0600); err != nil {
+		t.Fatalf("Failed to write user config: %v", err)
+	}
+
+	cfg, err := loadConfig(repoDir)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if cfg.apiURL != "https://api.staging.example.com" || cfg.webURL != "" {
+		t.Errorf("loadConfig() URLs = %q, %q", cfg.apiURL, cfg.webURL)
+	}
+	if cfg.proxy == nil || cfg.proxy.Host != "proxy.example.com:3128" {
+		t.Errorf("loadConfig() proxy = %v", cfg.proxy)
+	}
+
+	// The client trusts the server signed by the CA in the bundle
+	cfg.proxy = nil
+	resp, err := newHTTPClient(cfg).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with the CA bundle failed: %v", err)
+	}
+	resp.Body.Close()
+
+	// A repository can't redirect the token to another server
+	repoConfig := `{"server": {"apiUrl": "https://attacker.example.com"}}`
+	if err := os.WriteFile(filepath.Join(repoDir, repoConfigFileName), []byte(repoConfig), 0600); err != nil {
+		t.Fatalf("Failed to write repo config: %v", err)
+	}
+	if _, err := loadConfig(repoDir); err == nil {
+		t.Error("loadConfig() should refuse server settings in the repo config")
+	}
+
+	t.Setenv(caBundleEnvVar, filepath.Join(homeDir, "missing.pem"))
+	if _, err := loadConfig(""); err == nil {
+		t.Error("loadConfig() should fail on a missing CA bundle")
+	}
+}
+
+func TestLoadConfigWatch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	repoDir := t.TempDir()
+
+	repoConfig := `{"watch": {"quietPeriod": "500ms", "maxFiles": 50, "mode": "poll"}}`
+	if err := os.WriteFile(filepath.Join(repoDir, repoConfigFileName), []byte(repoConfig), 0600); err != nil {
+		t.Fatalf("Failed to write repo config: %v", err)
+	}
+
+	cfg, err := loadConfig(repoDir)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if cfg.watchQuietPeriod != 500*time.Millisecond || cfg.watchMaxWait != defaultWatchMaxWait {
+		t.Errorf("loadConfig() watch durations = %v, %v, want 500ms and the default", cfg.watchQuietPeriod, cfg.watchMaxWait)
+	}
+	if cfg.watchMode != watchModePoll || cfg.watchPollInterval != defaultWatchPollInterval {
+		t.Errorf("loadConfig() watch mode = %s every %v, want poll at the default interval", cfg.watchMode, cfg.watchPollInterval)
+	}
+	if cfg.watchMaxFiles != 50 || cfg.watchMaxBytes != 0 {
+		t.Errorf("loadConfig() watch limits = %d files, %d bytes, want 50 files and no byte limit", cfg.watchMaxFiles, cfg.watchMaxBytes)
+	}
+
+	linkOptions{maxWait: 2 * time.Second}.applyWatchFlags(cfg)
+	if cfg.watchMaxWait != 2*time.Second || cfg.watchQuietPeriod != 500*time.Millisecond {
+		t.Errorf("applyWatchFlags() = %v, %v, want the flag to override only the max wait", cfg.watchQuietPeriod, cfg.watchMaxWait)
+	}
+
+	for _, invalid := range []string{`{"watch": {"maxWait": "-1s"}}`, `{"watch": {"mode": "inotify"}}`} {
+		if err := os.WriteFile(filepath.Join(repoDir, repoConfigFileName), []byte(invalid), 0600); err != nil {
+			t.Fatalf("Failed to write repo config: %v", err)
+		}
+		if _, err := loadConfig(repoDir); err == nil {
+			t.Errorf("loadConfig() should fail on %s", invalid)
+		}
+	}
+}
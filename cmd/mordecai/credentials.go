@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zalando/go-keyring"
+	"os"
+)
+
+//                    _            _   _       _
+//   ___ _ __ ___  __| | ___ _ __ | |_(_) __ _| |___
+//  / __| '__/ _ \/ _` |/ _ \ '_ \| __| |/ _` | / __|
+// | (__| | |  __/ (_| |  __/ | | | |_| | (_| | \__ \
+//  \___|_|  \___|\__,_|\___|_| |_|\__|_|\__,_|_|___/
+//
+
+// keyringService is the name the token is stored under in the OS keyring
+const keyringService = "mordecai"
+
+// credentialStore keeps the login token between runs
+type credentialStore interface {
+	// load returns the saved token, or "" if there is none
+	load() (string, error)
+	save(token string) error
+	delete() error
+	// location describes where the token is kept, for auth status
+	location() string
+}
+
+// credentials is the store used for the login token of the active
+// profile, replaced in tests
+var credentials = credentialStoreFor(defaultProfileName)
+
+// keyringStore keeps the token in the OS keyring: the Keychain on macOS,
+// the Secret Service on Linux and the Credential Manager on Windows
+type keyringStore struct {
+	user string
+}
+
+func (s keyringStore) load() (string, error) {
+	token, err := keyring.Get(keyringService, s.user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", nil
+	}
+	return token, err
+}
+
+func (s keyringStore) save(token string) error {
+	return keyring.Set(keyringService, s.user, token)
+}
+
+func (s keyringStore) delete() error {
+	err := keyring.Delete(keyringService, s.user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s keyringStore) location() string {
+	return "the system keyring"
+}
+
+// fileStore keeps the token of a profile in a file only the user can read
+type fileStore struct {
+	profile string
+}
+
+func (s fileStore) load() (string, error) {
+	filePath, err := getProfileTokenFilePath(s.profile)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil // No token file found, but not an error
+		}
+		return "", fmt.Errorf("failed to load token: %w", err)
+	}
+	return string(data), nil
+}
+
+func (s fileStore) save(token string) error {
+	filePath, err := getProfileTokenFilePath(s.profile)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filePath, []byte(token), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+	return nil
+}
+
+func (s fileStore) delete() error {
+	filePath, err := getProfileTokenFilePath(s.profile)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	return nil
+}
+
+func (s fileStore) location() string {
+	filePath, err := getProfileTokenFilePath(s.profile)
+	if err != nil {
+		return "a file in ~/.mordecai"
+	}
+	return filePath
+}
+
+// memoryStore keeps the token for the life of the process
+type memoryStore struct {
+	token string
+}
+
+func (s *memoryStore) load() (string, error) {
+	return s.token, nil
+}
+
+func (s *memoryStore) save(token string) error {
+	s.token = token
+	return nil
+}
+
+func (s *memoryStore) delete() error {
+	s.token = ""
+	return nil
+}
+
+func (s *memoryStore) location() string {
+	return "memory"
+}
+
+// fallbackStore prefers the primary store and uses the fallback when the
+// primary isn't available, such as on a server without a keyring. A token
+// found in the fallback is moved to the primary once it works.
+type fallbackStore struct {
+	primary  credentialStore
+	fallback credentialStore
+	// active is the store the token was last found in or saved to
+	active credentialStore
+}
+
+func (s *fallbackStore) load() (string, error) {
+	token, err := s.primary.load()
+	if err == nil && token != "" {
+		s.active = s.primary
+		return token, nil
+	}
+	primaryAvailable := err == nil
+
+	token, err = s.fallback.load()
+	if err != nil || token == "" {
+		return token, err
+	}
+	s.active = s.fallback
+
+	if primaryAvailable && s.primary.save(token) == nil {
+		s.fallback.delete()
+		s.active = s.primary
+	}
+	return token, nil
+}
+
+func (s *fallbackStore) save(token string) error {
+	if err := s.primary.save(token); err == nil {
+		// Don't leave an older token behind in the fallback
+		s.fallback.delete()
+		s.active = s.primary
+		return nil
+	}
+
+	if err := s.fallback.save(token); err != nil {
+		return err
+	}
+	s.active = s.fallback
+	return nil
+}
+
+func (s *fallbackStore) delete() error {
+	s.active = nil
+	// A primary that can't be read, such as a missing keyring, has nothing
+	// to delete. Any other failure would leave the token behind, so it is
+	// reported.
+	var primaryErr error
+	if _, err := s.primary.load(); err == nil {
+		if err := s.primary.delete(); err != nil {
+			primaryErr = fmt.Errorf("failed to delete token from %s: %w", s.primary.location(), err)
+		}
+	}
+	return errors.Join(primaryErr, s.fallback.delete())
+}
+
+func (s *fallbackStore) location() string {
+	if s.active == nil {
+		return s.primary.location()
+	}
+	return s.active.location()
+}
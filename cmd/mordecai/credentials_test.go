@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// unavailableStore fails like a keyring on a machine without one
+type unavailableStore struct{}
+
+func (unavailableStore) load() (string, error)   { return "", errors.New("no keyring") }
+func (unavailableStore) save(token string) error { return errors.New("no keyring") }
+func (unavailableStore) delete() error           { return errors.New("no keyring") }
+func (unavailableStore) location() string        { return "nowhere" }
+
+// undeletableStore is a keyring that works but fails to delete
+type undeletableStore struct{ memoryStore }
+
+func (*undeletableStore) delete() error { return errors.New("permission denied") }
+
+func TestFallbackStore(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	tokenPath, err := getTokenFilePath()
+	if err != nil {
+		t.Fatalf("getTokenFilePath() error = %v", err)
+	}
+
+	// Without a keyring the token goes to the file
+	store := &fallbackStore{primary: unavailableStore{}, fallback: fileStore{profile: defaultProfileName}}
+	if err := store.save("file-token"); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+	if token, err := store.load(); err != nil || token != "file-token" {
+		t.Errorf("load() = %q, %v, want file-token", token, err)
+	}
+	if store.location() != tokenPath {
+		t.Errorf("location() = %q, want %q", store.location(), tokenPath)
+	}
+
+	// Once a keyring is available the token moves into it
+	keyring := &memoryStore{}
+	store = &fallbackStore{primary: keyring, fallback: fileStore{profile: defaultProfileName}}
+	if token, err := store.load(); err != nil || token != "file-token" {
+		t.Errorf("load() = %q, %v, want file-token", token, err)
+	}
+	if keyring.token != "file-token" {
+		t.Errorf("keyring token = %q, want the migrated file-token", keyring.token)
+	}
+	if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+		t.Errorf("token file should be removed after moving to the keyring, stat error = %v", err)
+	}
+	if store.location() != "memory" {
+		t.Errorf("location() = %q, want memory", store.location())
+	}
+
+	if err := store.delete(); err != nil {
+		t.Fatalf("delete() error = %v", err)
+	}
+	if token, _ := store.load(); token != "" {
+		t.Errorf("load() after delete = %q, want no token", token)
+	}
+
+	// Only an unavailable keyring is skipped, a failed delete is reported
+	if err := (&fallbackStore{primary: unavailableStore{}, fallback: fileStore{profile: defaultProfileName}}).delete(); err != nil {
+		t.Errorf("delete() without a keyring error = %v", err)
+	}
+	store = &fallbackStore{primary: &undeletableStore{memoryStore{token: "kept"}}, fallback: fileStore{profile: defaultProfileName}}
+	if err := store.delete(); err == nil {
+		t.Error("delete() should report a token it couldn't delete from the keyring")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+//                 _             _       _
+//   ___ _ __   __| |_ __   ___ (_)_ __ | |_ ___
+//  / _ \ '_ \ / _` | '_ \ / _ \| | '_ \| __/ __|
+// |  __/ | | | (_| | |_) | (_) | | | | | |_\__ \
+//  \___|_| |_|\__,_| .__/ \___/|_|_| |_|\__|___/
+//                  |_|
+//
+
+const (
+	apiURLEnvVar = "MORDECAI_API_URL"
+	webURLEnvVar = "MORDECAI_WEB_URL"
+)
+
+// apiURLFlag and webURLFlag hold --api-url and --web-url
+var (
+	apiURLFlag string
+	webURLFlag string
+)
+
+// profileAPIURL and profileWebURL are the URLs of the active profile's
+// server, empty when the profile uses the default one
+var (
+	profileAPIURL string
+	profileWebURL string
+)
+
+// apiBaseURL is the root of the API, from --api-url, MORDECAI_API_URL, the
+// active profile, the user config or the default site, in that order. The
+// profile comes before the config so an account set up for one server
+// never sends its token to another.
+func apiBaseURL() string {
+	return firstURL(apiURLFlag, os.Getenv(apiURLEnvVar), profileAPIURL, config.apiURL, "https://api."+siteUrl)
+}
+
+// webBaseURL is the root of the website the browser logs in on, picked
+// the same way as apiBaseURL
+func webBaseURL() string {
+	return firstURL(webURLFlag, os.Getenv(webURLEnvVar), profileWebURL, config.webURL, "https://"+siteUrl)
+}
+
+// useProfileEndpoints points the requests at the server of settings: its
+// saved URLs, or those of its host
+func useProfileEndpoints(settings profile) {
+	siteUrl = defaultSiteUrl
+	profileAPIURL, profileWebURL = settings.APIURL, settings.WebURL
+	if settings.Host != "" {
+		siteUrl = settings.Host
+		profileAPIURL = firstURL(settings.APIURL, "https://api."+settings.Host)
+		profileWebURL = firstURL(settings.WebURL, "https://"+settings.Host)
+	}
+}
+
+// apiEndpoint returns the URL of the API endpoint at path
+func apiEndpoint(path string) string {
+	return apiBaseURL() + path
+}
+
+func firstURL(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return strings.TrimRight(value, "/")
+		}
+	}
+	return ""
+}
+
+// setEndpointFlags checks the URLs from the flags and the environment and
+// uses the flags for the rest of the run
+func setEndpointFlags(apiURL, webURL string) error {
+	for _, setting := range []struct{ name, value string }{
+		{"--api-url", apiURL},
+		{"--web-url", webURL},
+		{apiURLEnvVar, os.Getenv(apiURLEnvVar)},
+		{webURLEnvVar, os.Getenv(webURLEnvVar)},
+	} {
+		if err := validateBaseURL(setting.name, setting.value); err != nil {
+			return err
+		}
+	}
+	apiURLFlag, webURLFlag = apiURL, webURL
+	return nil
+}
+
+// validateBaseURL checks that value, if set, is an http or https URL that
+// paths can be added to. Plain http is allowed for local test servers.
+func validateBaseURL(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return fmt.Errorf("%s must be an http or https URL such as https://api.mordecaiapp.com", name)
+	}
+	return nil
+}
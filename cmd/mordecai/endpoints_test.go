@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestEndpointPrecedence(t *testing.T) {
+	defer func(apiURL, webURL, profileAPI, profileWeb, host string, cfg *Config) {
+		apiURLFlag, webURLFlag, profileAPIURL, profileWebURL, siteUrl, config = apiURL, webURL, profileAPI, profileWeb, host, cfg
+	}(apiURLFlag, webURLFlag, profileAPIURL, profileWebURL, siteUrl, config)
+	t.Setenv(apiURLEnvVar, "")
+	t.Setenv(webURLEnvVar, "")
+
+	useProfileEndpoints(profile{Host: "mordecai.example.com"})
+	config = defaultConfig()
+	if err := setEndpointFlags("", ""); err != nil {
+		t.Fatalf("setEndpointFlags() error = %v", err)
+	}
+	if got := apiEndpoint("/cli/spaces"); got != "https://api.mordecai.example.com/cli/spaces" {
+		t.Errorf("apiEndpoint() = %s, want the API of the site", got)
+	}
+	if got := webBaseURL(); got != "https://mordecai.example.com" {
+		t.Errorf("webBaseURL() = %s, want the site", got)
+	}
+
+	// The config doesn't take a profile's token to another server
+	config.apiURL = "https://api.staging.example.com"
+	if got := apiBaseURL(); got != "https://api.mordecai.example.com" {
+		t.Errorf("apiBaseURL() = %s, want the API of the profile's host", got)
+	}
+	useProfileEndpoints(profile{})
+	if got := apiBaseURL(); got != config.apiURL {
+		t.Errorf("apiBaseURL() = %s, want the config URL for a profile on the default site", got)
+	}
+	useProfileEndpoints(profile{APIURL: "https://mordecai.internal/api", WebURL: "https://mordecai.internal"})
+	if got := apiBaseURL(); got != "https://mordecai.internal/api" {
+		t.Errorf("apiBaseURL() = %s, want the profile URL", got)
+	}
+	if got := webBaseURL(); got != "https://mordecai.internal" {
+		t.Errorf("webBaseURL() = %s, want the profile URL", got)
+	}
+
+	t.Setenv(apiURLEnvVar, "http://localhost:8080/")
+	if got := apiBaseURL(); got != "http://localhost:8080" {
+		t.Errorf("apiBaseURL() = %s, want the environment URL without the trailing slash", got)
+	}
+
+	if err := setEndpointFlags("https://mordecai.dev/api", "https://mordecai.dev"); err != nil {
+		t.Fatalf("setEndpointFlags() error = %v", err)
+	}
+	if got := apiBaseURL(); got != "https://mordecai.dev/api" {
+		t.Errorf("apiBaseURL() = %s, want the flag URL", got)
+	}
+	if got := webBaseURL(); got != "https://mordecai.dev" {
+		t.Errorf("webBaseURL() = %s, want the flag URL", got)
+	}
+
+	for _, invalid := range []string{"api.example.com", "ftp://api.example.com", "https://api.example.com?debug=1"} {
+		if err := setEndpointFlags(invalid, ""); err == nil {
+			t.Errorf("setEndpointFlags(%q) should fail", invalid)
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
-	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 )
 
 //
@@ -31,59 +32,32 @@ func readFile(filePath string) (string, error) {
 	return string(content), nil
 }
 
-func readDir(dirPath string) ([]string, error) {
+func readDir(dirPath string, ignorePatterns []string) ([]string, error) {
 	var files []string
 
-	// Create patterns list
-	ps := []gitignore.Pattern{
-		gitignore.ParsePattern(".git", nil),
-		gitignore.ParsePattern("node_modules", nil),
-		gitignore.ParsePattern("package-lock.json", nil),
-	}
-
-	// Read .gitignore file if it exists
-	gitignorePath := filepath.Join(dirPath, ".gitignore")
-	if data, err := os.ReadFile(gitignorePath); err == nil {
-		for _, line := range strings.Split(string(data), "\n") {
-			line = strings.TrimSpace(line)
-			if line != "" && !strings.HasPrefix(line, "#") {
-				ps = append(ps, gitignore.ParsePattern(line, nil))
-			}
-		}
+	// Build the same matcher the watcher uses
+	matcher, err := newIgnoreMatcher(dirPath, ignorePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ignore files: %v", err)
 	}
 
-	// Create matcher
-	matcher := gitignore.NewMatcher(ps)
-
 	// Walk directory
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get relative path for gitignore matching
-		relPath, err := filepath.Rel(dirPath, path)
+	err = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
 		// Skip if matched by gitignore
-		if matcher.Match(strings.Split(relPath, string(filepath.Separator)), info.IsDir()) {
+		if matcher.ignored(path, info.IsDir()) {
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		// Add file if it's not a directory and has supported extension
-		if !info.IsDir() {
-			ext := filepath.Ext(path)
-			for _, allowedExt := range supportedFileTypes {
-				if ext == allowedExt {
-					files = append(files, path)
-					break
-				}
-			}
+		// Add file if it's not a directory and is a supported file type
+		if !info.IsDir() && config.fileTypes.matches(path) {
+			files = append(files, path)
 		}
 		return nil
 	})
@@ -221,7 +195,7 @@ func (m Model) View() string {
 	// Status bar
 	s.WriteString("\n────────────\n")
 	s.WriteString("↑/↓: Navigate • Space/Enter: Expand/Collapse • q: Quit\n\n")
-	s.WriteString("\033[1;33m⚠ Check .gitignore if files are missing\033[0m\n")
+	s.WriteString("\033[1;33m⚠ Check .gitignore and .mordecaiignore if files are missing\033[0m\n")
 	s.WriteString("\033[1;33m⚠ See docs for supported languages\033[0m\n")
 
 	return s.String()
@@ -257,22 +231,97 @@ type FileContent struct {
 	DataChunks    string `json:"data_chunks"`
 }
 
+// FileRename moves a file the server already has to a new path
+type FileRename struct {
+	OldFilePath string `json:"old_file_path"`
+	NewFilePath string `json:"new_file_path"`
+}
+
+// fileChanges is everything a single /cli/chunk request applies to a
+// context. Renames and deletes are applied before file contents.
+type fileChanges struct {
+	Files   []FileContent
+	Deleted []string
+	Renamed []FileRename
+}
+
+func (c fileChanges) isEmpty() bool {
+	return len(c.Files) == 0 && len(c.Deleted) == 0 && len(c.Renamed) == 0
+}
+
+// skippedFile is a file that was left out of a sync, and why
+type skippedFile struct {
+	Path   string
+	Reason string
+}
+
+// sniffLength is how much of a file is checked for NUL bytes, the same
+// heuristic git uses to decide a file is binary
+const sniffLength = 8000
+
+// checkFileContent returns why the content can't be synced as text, or an
+// empty string if it can
+func checkFileContent(data []byte) string {
+	sniff := data
+	if len(sniff) > sniffLength {
+		sniff = sniff[:sniffLength]
+	}
+	if bytes.IndexByte(sniff, 0) != -1 {
+		return "binary content"
+	}
+	if !utf8.Valid(data) {
+		return "not valid UTF-8"
+	}
+	return ""
+}
+
+// readSyncableFile reads a file if it is small enough and looks like text.
+// Otherwise it returns the reason the file is skipped.
+func readSyncableFile(filePath string) (string, string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	if info.Size() > config.maxFileBytes {
+		return "", fmt.Sprintf("larger than %s", formatBytes(config.maxFileBytes)), nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	if reason := checkFileContent(data); reason != "" {
+		return "", reason, nil
+	}
+
+	return string(data), "", nil
+}
+
 func getFileContents(files []string) ([]FileContent, error) {
-	var fileContents []FileContent
 	currentDir, err := os.Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("error getting current directory: %v", err)
 	}
-	baseDir := filepath.Base(currentDir)
+	fileContents, _, err := collectFileContents(currentDir, files)
+	return fileContents, err
+}
+
+// collectFileContents reads the files to send, leaving out anything that is
+// binary or too large. Paths are sent relative to root.
+func collectFileContents(root string, files []string) ([]FileContent, []skippedFile, error) {
+	var fileContents []FileContent
+	var skipped []skippedFile
 
 	for _, filePath := range files {
 
-		relPath, err := filepath.Rel(currentDir, filePath)
-		fullRelPath := filepath.Join(baseDir, relPath)
+		fullRelPath, err := remoteFilePath(root, filePath)
+		if err != nil {
+			return nil, nil, err
+		}
 		// Check if it's a regular file
 		info, err := os.Stat(filePath)
 		if err != nil {
-			return nil, fmt.Errorf("error getting file info for %s: %v", filePath, err)
+			return nil, nil, fmt.Errorf("error getting file info for %s: %v", filePath, err)
 			// Should a continue be here?
 		}
 		if !info.Mode().IsRegular() {
@@ -282,18 +331,19 @@ func getFileContents(files []string) ([]FileContent, error) {
 		// Get file extension
 		ext := filepath.Ext(filePath)
 
-		// Check if it's an allowed file type (you can modify this list as needed)
-
-		if !contains(supportedFileTypes, ext) {
+		// Check if it's an allowed file type (see config.go to change the list)
+		if !config.fileTypes.matches(filePath) {
 			continue
 		}
 
 		// Read file content
-		content, err := readFile(filePath)
+		content, reason, err := readSyncableFile(filePath)
 		if err != nil {
-			return nil, fmt.Errorf("error reading file %s: %v", filePath, err)
-			// Should a continue be here?
-
+			return nil, nil, fmt.Errorf("error reading file %s: %v", filePath, err)
+		}
+		if reason != "" {
+			skipped = append(skipped, skippedFile{Path: fullRelPath, Reason: reason})
+			continue
 		}
 
 		fileContents = append(fileContents, FileContent{
@@ -303,7 +353,18 @@ func getFileContents(files []string) ([]FileContent, error) {
 		})
 	}
 
-	return fileContents, nil
+	return fileContents, skipped, nil
+}
+
+// printSkippedFiles reports the files that were left out of a sync
+func printSkippedFiles(skipped []skippedFile) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Printf("\033[1;33m⚠ Skipped %d files:\033[0m\n", len(skipped))
+	for _, file := range skipped {
+		fmt.Printf("  %s (%s)\n", file.Path, file.Reason)
+	}
 }
 
 // Helper function to check if a slice contains a string
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -53,7 +54,7 @@ func TestReadDir(t *testing.T) {
 	}
 
 	// Test reading the directory
-	files, err := readDir(tmpDir)
+	files, err := readDir(tmpDir, nil)
 	if err != nil {
 		t.Errorf("readDir() error = %v", err)
 	}
@@ -121,3 +122,71 @@ func TestContains(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckFileContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"Plain text", []byte("package main\n"), ""},
+		{"Unicode text", []byte("const greeting = \"héllo 👋\""), ""},
+		{"NUL byte", []byte("GIF89a\x00\x01"), "binary content"},
+		{"Invalid UTF-8", []byte{0xff, 0xfe, 'a'}, "not valid UTF-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := checkFileContent(tt.data); result != tt.expected {
+				t.Errorf("checkFileContent() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCollectFileContentsSkipsFiles(t *testing.T) {
+	originalConfig := config
+	config = defaultConfig()
+	config.maxFileBytes = 100
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		return path
+	}
+
+	files := []string{
+		writeFile("a.js", []byte(strings.Repeat("a", 80))),
+		writeFile("huge.js", []byte(strings.Repeat("h", 101))),
+		writeFile("image.json", []byte("{\x00}")),
+		writeFile("b.js", []byte(strings.Repeat("b", 80))),
+		writeFile("c.js", []byte(strings.Repeat("c", 60))),
+	}
+
+	contents, skipped, err := collectFileContents(tmpDir, files)
+	if err != nil {
+		t.Fatalf("collectFileContents() error = %v", err)
+	}
+
+	if len(contents) != 3 {
+		t.Errorf("collectFileContents() returned %d files, want 3", len(contents))
+	}
+
+	reasons := make(map[string]string)
+	for _, file := range skipped {
+		reasons[filepath.Base(file.Path)] = file.Reason
+	}
+	if !strings.HasPrefix(reasons["huge.js"], "larger than") {
+		t.Errorf("huge.js skip reason = %q, want larger than limit", reasons["huge.js"])
+	}
+	if reasons["image.json"] != "binary content" {
+		t.Errorf("image.json skip reason = %q, want binary content", reasons["image.json"])
+	}
+	if len(skipped) != 2 {
+		t.Errorf("collectFileContents() skipped %v, want huge.js and image.json", skipped)
+	}
+}
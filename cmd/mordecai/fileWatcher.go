@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//   __ _ _                    _       _
+//  / _(_) | _____      ____ _| |_ ___| |__   ___ _ __
+// | |_| | |/ _ \ \ /\ / / _` | __/ __| '_ \ / _ \ '__|
+// |  _| | |  __/\ V  V / (_| | || (__| | | |  __/ |
+// |_| |_|_|\___| \_/\_/ \__,_|\__\___|_| |_|\___|_|
+//
+
+// Ways of watching for changes
+const (
+	// watchModeAuto uses OS notifications, polling the directories they
+	// can't be registered for
+	watchModeAuto = "auto"
+	// watchModePoll polls every directory, for filesystems that don't
+	// deliver notifications such as NFS, Docker bind mounts and WSL
+	watchModePoll = "poll"
+)
+
+// fileWatcher reports changes to the files and directories directly inside
+// the directories added to it
+type fileWatcher interface {
+	add(dir string) error
+	remove(dir string) error
+	events() <-chan fsnotify.Event
+	errors() <-chan error
+	close() error
+}
+
+// newFileWatcher returns the watcher for mode. In auto mode the watcher
+// falls back to polling for directories inotify can't watch, or entirely
+// if it can't be used at all.
+func newFileWatcher(mode string, pollInterval time.Duration) fileWatcher {
+	if mode == watchModePoll {
+		return newPollingWatcher(pollInterval)
+	}
+
+	notify, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Printf("\033[1;33m⚠ File notifications are unavailable (%v), checking for changes every %s instead\033[0m\n", err, pollInterval)
+		return newPollingWatcher(pollInterval)
+	}
+	return newFallbackWatcher(fsnotifyWatcher{notify}, newPollingWatcher(pollInterval))
+}
+
+// fsnotifyWatcher gets changes from the OS, through inotify on Linux
+type fsnotifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func (w fsnotifyWatcher) add(dir string) error          { return w.Add(dir) }
+func (w fsnotifyWatcher) remove(dir string) error       { return w.Remove(dir) }
+func (w fsnotifyWatcher) events() <-chan fsnotify.Event { return w.Events }
+func (w fsnotifyWatcher) errors() <-chan error          { return w.Errors }
+func (w fsnotifyWatcher) close() error                  { return w.Close() }
+
+// pollEntry is the state of a file or directory at the last poll
+type pollEntry struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+	// hash is only taken once the file changes, so a file that is later
+	// touched without being edited isn't reported
+	hash string
+}
+
+// pollingWatcher finds changes by listing every directory at an interval
+// and comparing the size, modification time and content of its files
+type pollingWatcher struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	dirs map[string]map[string]pollEntry
+
+	eventsCh  chan fsnotify.Event
+	errorsCh  chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPollingWatcher(interval time.Duration) *pollingWatcher {
+	w := &pollingWatcher{
+		interval: interval,
+		dirs:     make(map[string]map[string]pollEntry),
+		eventsCh: make(chan fsnotify.Event),
+		errorsCh: make(chan error),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *pollingWatcher) add(dir string) error {
+	entries, err := scanPollDir(dir, nil)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirs[dir] = entries
+	return nil
+}
+
+func (w *pollingWatcher) remove(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.dirs, dir)
+	return nil
+}
+
+func (w *pollingWatcher) events() <-chan fsnotify.Event { return w.eventsCh }
+func (w *pollingWatcher) errors() <-chan error          { return w.errorsCh }
+
+func (w *pollingWatcher) close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollingWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			for _, event := range w.poll() {
+				select {
+				case w.eventsCh <- event:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// poll lists every watched directory and returns what changed since the
+// last poll, in the form fsnotify reports it
+func (w *pollingWatcher) poll() []fsnotify.Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var events []fsnotify.Event
+	for _, dir := range sortedKeys(w.dirs) {
+		previous := w.dirs[dir]
+		current, err := scanPollDir(dir, previous)
+		if err != nil {
+			// A removed directory is reported by the poll of its parent
+			if errors.Is(err, os.ErrNotExist) {
+				delete(w.dirs, dir)
+			}
+			continue
+		}
+
+		for _, name := range sortedKeys(current) {
+			path := filepath.Join(dir, name)
+			before, existed := previous[name]
+			after := current[name]
+			switch {
+			case !existed:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case before.isDir != after.isDir:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove}, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case !after.isDir && (before.size != after.size || !before.modTime.Equal(after.modTime)):
+				if before.hash == "" || after.hash == "" || before.hash != after.hash {
+					events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+				}
+			}
+		}
+		for _, name := range sortedKeys(previous) {
+			if _, ok := current[name]; !ok {
+				events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+			}
+		}
+		w.dirs[dir] = current
+	}
+	return events
+}
+
+// scanPollDir lists dir. Files whose size or modification time changed
+// since previous are hashed to tell edits from touches.
+func scanPollDir(dir string, previous map[string]pollEntry) (map[string]pollEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]pollEntry, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entry := pollEntry{isDir: info.IsDir(), size: info.Size(), modTime: info.ModTime()}
+		if before, ok := previous[dirEntry.Name()]; ok && !entry.isDir {
+			entry.hash = before.hash
+			if before.size != entry.size || !before.modTime.Equal(entry.modTime) {
+				entry.hash, _ = hashFile(filepath.Join(dir, dirEntry.Name()))
+			}
+		}
+		entries[dirEntry.Name()] = entry
+	}
+	return entries, nil
+}
+
+// fallbackWatcher watches directories with the primary watcher and polls
+// the ones it can't take, such as once inotify runs out of watches
+type fallbackWatcher struct {
+	primary  fileWatcher
+	fallback fileWatcher
+
+	// polled holds the directories the fallback watches, and only belongs
+	// to the goroutine calling add and remove
+	polled map[string]bool
+	// failures counts the directories the primary couldn't watch, and
+	// firstErr says why
+	failures int
+	firstErr error
+
+	eventsCh chan fsnotify.Event
+	errorsCh chan error
+	done     chan struct{}
+}
+
+func newFallbackWatcher(primary, fallback fileWatcher) *fallbackWatcher {
+	w := &fallbackWatcher{
+		primary:  primary,
+		fallback: fallback,
+		polled:   make(map[string]bool),
+		eventsCh: make(chan fsnotify.Event),
+		errorsCh: make(chan error),
+		done:     make(chan struct{}),
+	}
+	for _, source := range []fileWatcher{primary, fallback} {
+		go forward(source.events(), w.eventsCh, w.done)
+		go forward(source.errors(), w.errorsCh, w.done)
+	}
+	return w
+}
+
+// forward passes values from in to out until in or done is closed
+func forward[T any](in <-chan T, out chan<- T, done <-chan struct{}) {
+	for {
+		select {
+		case value, ok := <-in:
+			if !ok {
+				return
+			}
+			select {
+			case out <- value:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (w *fallbackWatcher) add(dir string) error {
+	err := w.primary.add(dir)
+	if err == nil {
+		return nil
+	}
+
+	if fallbackErr := w.fallback.add(dir); fallbackErr != nil {
+		return fallbackErr
+	}
+	w.polled[dir] = true
+	w.failures++
+	if w.firstErr == nil {
+		w.firstErr = err
+	}
+	return nil
+}
+
+func (w *fallbackWatcher) remove(dir string) error {
+	if w.polled[dir] {
+		delete(w.polled, dir)
+		return w.fallback.remove(dir)
+	}
+	return w.primary.remove(dir)
+}
+
+func (w *fallbackWatcher) events() <-chan fsnotify.Event { return w.eventsCh }
+func (w *fallbackWatcher) errors() <-chan error          { return w.errorsCh }
+
+func (w *fallbackWatcher) close() error {
+	close(w.done)
+	w.fallback.close()
+	return w.primary.close()
+}
+
+// warnPolledDirectories reports how many directories are polled because
+// OS notifications couldn't be registered for them, once per new failure
+func warnPolledDirectories(watcher fileWatcher, pollInterval time.Duration, reported *int) {
+	w, ok := watcher.(*fallbackWatcher)
+	if !ok || w.failures == *reported {
+		return
+	}
+	*reported = w.failures
+	fmt.Printf("\033[1;33m⚠ %d directories couldn't be watched for changes (%v) and are checked every %s instead.\033[0m\n", w.failures, w.firstErr, pollInterval)
+	fmt.Println("  On Linux, raising fs.inotify.max_user_watches lets every directory be watched:")
+	fmt.Println("  sudo sysctl fs.inotify.max_user_watches=524288")
+}
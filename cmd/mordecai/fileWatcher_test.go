@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for the next event of watcher, or fails the test
+func nextEvent(t *testing.T, watcher fileWatcher) fsnotify.Event {
+	t.Helper()
+	select {
+	case event := <-watcher.events():
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event arrived")
+		return fsnotify.Event{}
+	}
+}
+
+// expectNoEvent fails the test if watcher reports anything for a while
+func expectNoEvent(t *testing.T, watcher fileWatcher) {
+	t.Helper()
+	select {
+	case event := <-watcher.events():
+		t.Errorf("unexpected event %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPollingWatcher(t *testing.T) {
+	dir := t.TempDir()
+	watcher := newPollingWatcher(10 * time.Millisecond)
+	defer watcher.close()
+	if err := watcher.add(dir); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+
+	filePath := filepath.Join(dir, "main.go")
+	steps := []struct {
+		name   string
+		change func() error
+		op     fsnotify.Op
+	}{
+		{name: "Create", op: fsnotify.Create, change: func() error {
+			return os.WriteFile(filePath, []byte("package main"), 0666)
+		}},
+		{name: "Edit", op: fsnotify.Write, change: func() error {
+			return os.WriteFile(filePath, []byte("package main // edited"), 0666)
+		}},
+		{name: "Touch", change: func() error {
+			later := time.Now().Add(time.Hour)
+			return os.Chtimes(filePath, later, later)
+		}},
+		{name: "Edit with the same size", op: fsnotify.Write, change: func() error {
+			return os.WriteFile(filePath, []byte("package main // EDITED"), 0666)
+		}},
+		{name: "Remove", op: fsnotify.Remove, change: func() error {
+			return os.Remove(filePath)
+		}},
+	}
+
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if step.op == 0 {
+			expectNoEvent(t, watcher)
+			continue
+		}
+		if event := nextEvent(t, watcher); event.Name != filePath || event.Op != step.op {
+			t.Errorf("%s: event = %v, want %v of %s", step.name, event, step.op, filePath)
+		}
+	}
+
+	// A removed directory is no longer polled
+	watcher.remove(dir)
+	if err := os.WriteFile(filePath, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	expectNoEvent(t, watcher)
+}
+
+// failingWatcher can't watch anything, like inotify out of watches
+type failingWatcher struct{}
+
+func (failingWatcher) add(dir string) error          { return errors.New("no space left on device") }
+func (failingWatcher) remove(dir string) error       { return nil }
+func (failingWatcher) events() <-chan fsnotify.Event { return nil }
+func (failingWatcher) errors() <-chan error          { return nil }
+func (failingWatcher) close() error                  { return nil }
+
+func TestFallbackWatcher(t *testing.T) {
+	dir := t.TempDir()
+	watcher := newFallbackWatcher(failingWatcher{}, newPollingWatcher(10*time.Millisecond))
+	defer watcher.close()
+
+	if err := watcher.add(dir); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if !watcher.polled[dir] || watcher.failures != 1 || watcher.firstErr == nil {
+		t.Fatalf("fallbackWatcher = %d failures, polled %v, want the directory polled", watcher.failures, watcher.polled)
+	}
+
+	filePath := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(filePath, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if event := nextEvent(t, watcher); event.Name != filePath || event.Op != fsnotify.Create {
+		t.Errorf("event = %v, want the create from polling", event)
+	}
+
+	if err := watcher.add(filepath.Join(dir, "missing")); err == nil {
+		t.Error("add() should fail when neither watcher can watch the directory")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+//        _ _       _        _
+//   __ _(_) |_ ___| |_ __ _| |_ ___
+//  / _` | | __/ __| __/ _` | __/ _ \
+// | (_| | | |_\__ \ || (_| | ||  __/
+//  \__, |_|\__|___/\__\__,_|\__\___|
+//  |___/
+//
+
+// gitHead is the commit a working tree has checked out
+type gitHead struct {
+	// Branch is empty when HEAD is detached, such as during a rebase
+	Branch string
+	Commit string
+}
+
+func (h gitHead) String() string {
+	commit := h.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if h.Branch == "" {
+		return fmt.Sprintf("detached HEAD at %s", commit)
+	}
+	return fmt.Sprintf("branch %s at %s", h.Branch, commit)
+}
+
+// activeGitHead is the HEAD of the linked repository, sent with uploads so
+// the context says which branch and commit it reflects. It is nil outside
+// a git repository.
+var activeGitHead atomic.Pointer[gitHead]
+
+// readGitHead returns the HEAD of the git repository dir is in and the
+// git directory holding it. ok is false outside a repository and before
+// the first commit.
+func readGitHead(dir string) (head gitHead, gitDir string, ok bool) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true, EnableDotGitCommonDir: true})
+	if err != nil {
+		return gitHead{}, "", false
+	}
+	if storage, isFS := repo.Storer.(*filesystem.Storage); isFS {
+		gitDir = storage.Filesystem().Root()
+	}
+
+	ref, err := repo.Head()
+	if err != nil {
+		return gitHead{}, gitDir, false
+	}
+	head.Commit = ref.Hash().String()
+	if ref.Name().IsBranch() {
+		head.Branch = ref.Name().Short()
+	}
+	return head, gitDir, gitDir != ""
+}
+
+// watchGitDir watches the files that move when a branch is switched,
+// committed to or rebased: HEAD, packed-refs and the branches in refs/heads
+func watchGitDir(watcher fileWatcher, gitDir string) error {
+	if err := watcher.add(gitDir); err != nil {
+		return err
+	}
+	return filepath.WalkDir(filepath.Join(gitDir, "refs", "heads"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		return watcher.add(path)
+	})
+}
+
+// isGitRefPath reports whether path is one of the files watchGitDir is
+// interested in. Lock files are skipped, as git renames them into place
+// once the change is complete.
+func isGitRefPath(gitDir, path string) bool {
+	rel, err := filepath.Rel(gitDir, path)
+	if err != nil || strings.HasSuffix(rel, ".lock") {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	return rel == "HEAD" || rel == "packed-refs" || rel == "refs/heads" || strings.HasPrefix(rel, "refs/heads/")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//  _
+// (_) __ _ _ __   ___  _ __ ___
+// | |/ _` | '_ \ / _ \| '__/ _ \
+// | | (_| | | | | (_) | | |  __/
+// |_|\__, |_| |_|\___/|_|  \___|
+//    |___/
+
+// Patterns that are never worth syncing, even without a .gitignore. They
+// have the lowest priority so a repository can still re-include them. The
+// repository's own mordecai config and ignore files are settings, not code.
+var defaultIgnorePatterns = []string{"node_modules", "package-lock.json", "/" + repoConfigFileName, mordecaiIgnoreFile}
+
+// mordecaiIgnoreFile uses gitignore syntax to control what is sent to the
+// remote space independently of what is committed to git
+const mordecaiIgnoreFile = ".mordecaiignore"
+
+// ignoreMatcher decides which paths in a repository are excluded. It is
+// shared by readDir and the watcher so both agree on what is tracked, and
+// follows git's sources and precedence: system and global excludes, then
+// .git/info/exclude, then every .gitignore from the root down. Patterns
+// from .mordecaiignore files and the command line are applied on top, so
+// they can exclude committed files or re-include gitignored ones.
+type ignoreMatcher struct {
+	root    string
+	extra   []string
+	matcher gitignore.Matcher
+}
+
+// newIgnoreMatcher reads the ignore files of the repository at root. The
+// extra patterns come from --exclude and --include (as "!pattern") in the
+// order they were given, and take priority over every ignore file.
+func newIgnoreMatcher(root string, extraPatterns []string) (*ignoreMatcher, error) {
+	var ps []gitignore.Pattern
+	for _, pattern := range defaultIgnorePatterns {
+		ps = append(ps, gitignore.ParsePattern(pattern, nil))
+	}
+
+	rootFs := osfs.New("/")
+	if systemPatterns, err := gitignore.LoadSystemPatterns(rootFs); err == nil {
+		ps = append(ps, systemPatterns...)
+	}
+	globalPatterns, err := gitignore.LoadGlobalPatterns(rootFs)
+	if err == nil && len(globalPatterns) == 0 {
+		globalPatterns, err = readDefaultGlobalExcludes()
+	}
+	if err == nil {
+		ps = append(ps, globalPatterns...)
+	}
+
+	infoExclude, err := readIgnoreFile(filepath.Join(root, ".git", "info", "exclude"), nil)
+	if err != nil {
+		return nil, err
+	}
+	ps = append(ps, infoExclude...)
+
+	var extra []gitignore.Pattern
+	for _, pattern := range extraPatterns {
+		extra = append(extra, gitignore.ParsePattern(pattern, nil))
+	}
+
+	m := &ignoreMatcher{root: root, extra: extraPatterns}
+	gitPatterns, mordecaiPatterns, err := m.readPatterns(ps, nil, extra, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.matcher = gitignore.NewMatcher(append(append(gitPatterns, mordecaiPatterns...), extra...))
+
+	return m, nil
+}
+
+// reload reads the ignore files again, after one of them changed
+func (m *ignoreMatcher) reload() (*ignoreMatcher, error) {
+	return newIgnoreMatcher(m.root, m.extra)
+}
+
+// readPatterns collects the .gitignore and .mordecaiignore files below
+// domain, each in ascending order of priority. Like git, it doesn't look
+// inside ignored directories.
+func (m *ignoreMatcher) readPatterns(gitPatterns []gitignore.Pattern, mordecaiPatterns []gitignore.Pattern, extra []gitignore.Pattern, domain []string) ([]gitignore.Pattern, []gitignore.Pattern, error) {
+	dirPath := filepath.Join(append([]string{m.root}, domain...)...)
+
+	patterns, err := readIgnoreFile(filepath.Join(dirPath, ".gitignore"), domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	gitPatterns = append(gitPatterns, patterns...)
+
+	patterns, err = readIgnoreFile(filepath.Join(dirPath, mordecaiIgnoreFile), domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	mordecaiPatterns = append(mordecaiPatterns, patterns...)
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading directory %s: %v", dirPath, err)
+	}
+
+	var ps []gitignore.Pattern
+	ps = append(ps, gitPatterns...)
+	ps = append(ps, mordecaiPatterns...)
+	ps = append(ps, extra...)
+	matcher := gitignore.NewMatcher(ps)
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == ".git" {
+			continue
+		}
+		subdomain := append(append([]string{}, domain...), entry.Name())
+		if matcher.Match(subdomain, true) {
+			continue
+		}
+		gitPatterns, mordecaiPatterns, err = m.readPatterns(gitPatterns, mordecaiPatterns, extra, subdomain)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return gitPatterns, mordecaiPatterns, nil
+}
+
+// ignored reports whether the path, absolute or relative to the root, is
+// excluded from syncing
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	relPath := path
+	if filepath.IsAbs(path) {
+		var err error
+		if relPath, err = filepath.Rel(m.root, path); err != nil {
+			return true
+		}
+	}
+	if relPath == "." {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	if parts[0] == ".." {
+		return true
+	}
+	for _, part := range parts {
+		if part == ".git" {
+			return true
+		}
+	}
+
+	return m.matcher.Match(parts, isDir)
+}
+
+// isIgnoreFile reports whether a change to the path can change what is
+// ignored, so the matcher needs to be rebuilt
+func isIgnoreFile(path string) bool {
+	base := filepath.Base(path)
+	return base == ".gitignore" || base == mordecaiIgnoreFile || strings.HasSuffix(filepath.ToSlash(path), ".git/info/exclude")
+}
+
+func readIgnoreFile(filePath string, domain []string) ([]gitignore.Pattern, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error opening %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	var ps []gitignore.Pattern
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(line, domain))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", filePath, err)
+	}
+
+	return ps, nil
+}
+
+// readDefaultGlobalExcludes reads the file git uses for global excludes
+// when core.excludesFile isn't set
+func readDefaultGlobalExcludes() ([]gitignore.Pattern, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		configHome = filepath.Join(homeDir, ".config")
+	}
+	return readIgnoreFile(filepath.Join(configHome, "git", "ignore"), nil)
+}
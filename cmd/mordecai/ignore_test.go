@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	repoDir := t.TempDir()
+	files := map[string]string{
+		".gitignore":              "*.log\nbuild/\n",
+		".git/info/exclude":       "scratch.go\n",
+		"pkg/.gitignore":          "generated.go\n!keep.log\n",
+		"pkg/api.go":              "",
+		"pkg/generated.go":        "",
+		"pkg/keep.log":            "",
+		"pkg/debug.log":           "",
+		"build/.gitignore":        "!*\n",
+		"build/out.go":            "",
+		"node_modules/x/index.js": "",
+		"scratch.go":              "",
+		"main.go":                 "",
+		".mordecai.json":          "{}",
+		".mordecaiignore":         "",
+	}
+	for name, content := range files {
+		path := filepath.Join(repoDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	matcher, err := newIgnoreMatcher(repoDir, nil)
+	if err != nil {
+		t.Fatalf("newIgnoreMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"main.go", false, false},
+		{"pkg/api.go", false, false},
+		{"pkg/generated.go", false, true},
+		{"generated.go", false, false},
+		{"pkg/debug.log", false, true},
+		{"pkg/keep.log", false, false},
+		{"build", true, true},
+		{"scratch.go", false, true},
+		{"node_modules", true, true},
+		{".git", true, true},
+		{".git/config", false, true},
+		{".mordecai.json", false, true},
+		{".mordecaiignore", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			result := matcher.ignored(filepath.Join(repoDir, filepath.FromSlash(tt.path)), tt.isDir)
+			if result != tt.expected {
+				t.Errorf("ignored(%v) = %v, want %v", tt.path, result, tt.expected)
+			}
+		})
+	}
+
+	// readDir must agree with the matcher
+	found, err := readDir(repoDir, nil)
+	if err != nil {
+		t.Fatalf("readDir() error = %v", err)
+	}
+	want := map[string]bool{
+		filepath.Join(repoDir, "main.go"):    true,
+		filepath.Join(repoDir, "pkg/api.go"): true,
+	}
+	if len(found) != len(want) {
+		t.Errorf("readDir() = %v, want %v", found, want)
+	}
+	for _, path := range found {
+		if !want[path] {
+			t.Errorf("readDir() returned ignored file %v", path)
+		}
+	}
+}
+
+func TestMordecaiIgnore(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	repoDir := t.TempDir()
+	files := map[string]string{
+		".gitignore":           "generated.go\ndist/\n",
+		".mordecaiignore":      "!generated.go\nfixtures/*\n",
+		"sdk/.mordecaiignore":  "*\n",
+		"generated.go":         "",
+		"dist/bundle.js":       "",
+		"fixtures/big.json":    "",
+		"fixtures/keep.go":     "",
+		"api.pb.go":            "",
+		"sdk/client.go":        "",
+		"main.go":              "",
+		"unrelated/dist/x.go":  "",
+		"unrelated/handler.go": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(repoDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	matcher, err := newIgnoreMatcher(repoDir, []string{"*.pb.go", "!fixtures/keep.go"})
+	if err != nil {
+		t.Fatalf("newIgnoreMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"main.go", false},
+		{"generated.go", false},
+		{"dist/bundle.js", true},
+		{"fixtures/big.json", true},
+		{"fixtures/keep.go", false},
+		{"api.pb.go", true},
+		{"sdk/client.go", true},
+		{"unrelated/handler.go", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			result := matcher.ignored(filepath.Join(repoDir, filepath.FromSlash(tt.path)), false)
+			if result != tt.expected {
+				t.Errorf("ignored(%v) = %v, want %v", tt.path, result, tt.expected)
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -18,8 +25,14 @@ var supportedFileTypes = []string{
 	".zig", ".php", ".ts", ".mts", ".cts", ".js", ".mjs", ".cjs",
 }
 
+// defaultSiteUrl is the host used by profiles that don't set their own
+const defaultSiteUrl = "mordecaiapp.com"
+
 var (
-	siteUrl = "mordecaiapp.com"
+	siteUrl = defaultSiteUrl
+
+	// assumeYes answers yes to every confirmation prompt (--yes)
+	assumeYes = false
 )
 
 //                          _                _
@@ -39,19 +52,53 @@ func main() {
 
 	command := os.Args[1]
 
+	// The first Ctrl+C cancels the request in flight so a sync can stop
+	// cleanly; a second one exits straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	switch command {
 	case "link":
+		opts := parseLinkFlags("link", os.Args[2:])
+		loadActiveConfig()
+		opts.applyWatchFlags(config)
 
-		if len(os.Args) < 2 {
-			fmt.Println("Usage: mordecai <commands>")
+		if !opts.noUpdateCheck {
+			updateVersion(ctx)
+		}
+		if err := linkCommand(ctx, opts); err != nil {
+			fmt.Println(err)
+			if errors.Is(err, context.Canceled) {
+				os.Exit(exitInterrupted)
+			}
 			os.Exit(1)
 		}
 
-		updateVersion()
-		linkCommand()
+	case "push":
+		opts := parseLinkFlags("push", os.Args[2:])
+		loadActiveConfig()
 
+		if !opts.noUpdateCheck {
+			updateVersion(ctx)
+		}
+		os.Exit(pushCommand(ctx, opts))
+
+	case "types":
+		loadActiveConfig()
+		typesCommand()
+
+	case "login":
+		os.Exit(loginCommand(ctx, os.Args[2:]))
+	case "auth":
+		os.Exit(authCommand(os.Args[2:]))
+	case "profiles":
+		os.Exit(profilesCommand(os.Args[2:]))
 	case "logout":
-		logoutCommand()
+		os.Exit(logoutCommand(os.Args[2:]))
 	case "--help":
 		helpCommand()
 	case "--version":
@@ -77,101 +124,595 @@ func main() {
 // |___/\__,_|_.__/ \___\___/|_| |_| |_|_| |_| |_|\__,_|_| |_|\__,_|___/
 //
 
-func linkCommand() {
+// Exit codes returned by push
+const (
+	exitSuccess     = 0
+	exitSyncFailure = 1
+	exitUsage       = 2
+	exitAuthFailure = 3
+	exitInterrupted = 130
+)
+
+var errNotLoggedIn = errors.New("Not logged in. Set MORDECAI_TOKEN or run 'mordecai login' to log in.")
+
+// isAuthFailure reports whether err means there is no token the server
+// accepts and none could be had by logging in
+func isAuthFailure(err error) bool {
+	return errors.Is(err, errNotLoggedIn) || isAPIError(err, apiErrorAuth)
+}
+
+// linkOptions holds the flags accepted by link and push
+type linkOptions struct {
+	space         string
+	repo          string
+	noUpdateCheck bool
+	yes           bool
+	noWatch       bool
+	full          bool
+	profile       string
+	apiURL        string
+	webURL        string
+
+	// ignorePatterns are the --exclude and --include (as "!pattern")
+	// patterns in the order given
+	ignorePatterns []string
+
+	// Watcher batching, overriding the config when set
+	quietPeriod   time.Duration
+	maxWait       time.Duration
+	maxBatchFiles int
+	maxBatchBytes int64
+	watchMode     string
+	pollInterval  time.Duration
+}
+
+// ignoreFlag collects --include and --exclude patterns in the order given
+type ignoreFlag struct {
+	patterns *[]string
+	negate   bool
+}
 
-	// Check if token is valid
-	if tokenIsValid, err := checkIfTokenIsValid(); err != nil {
-		fmt.Printf("Error checking token: %v\n", err)
-		return
-	} else if !tokenIsValid {
-		authenticate()
-		// This needs to be updated soon
+func (f ignoreFlag) String() string { return "" }
+
+func (f ignoreFlag) Set(pattern string) error {
+	if f.negate {
+		pattern = "!" + pattern
 	}
+	*f.patterns = append(*f.patterns, pattern)
+	return nil
+}
 
-	var token, tokenErr = loadToken()
+func parseLinkFlags(name string, args []string) linkOptions {
+	var opts linkOptions
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.space, "space", "", "ID or name of the space to sync to, skipping the space picker")
+	flags.StringVar(&opts.repo, "repo", "", "Name of the repository in the space (defaults to the git remote or directory name)")
+	flags.BoolVar(&opts.noUpdateCheck, "no-update-check", false, "Do not check for a newer version of mordecai")
+	flags.BoolVar(&opts.yes, "yes", false, "Answer yes to every prompt")
+	flags.StringVar(&opts.profile, "profile", "", "Profile to use instead of the current one")
+	flags.StringVar(&opts.apiURL, "api-url", "", "URL of the Mordecai API, for staging or self-hosted servers")
+	flags.StringVar(&opts.webURL, "web-url", "", "URL of the Mordecai website, for logging in to staging or self-hosted servers")
+	flags.Var(ignoreFlag{patterns: &opts.ignorePatterns}, "exclude", "Gitignore-style pattern of files not to sync (repeatable)")
+	flags.Var(ignoreFlag{patterns: &opts.ignorePatterns, negate: true}, "include", "Gitignore-style pattern of ignored files to sync anyway (repeatable)")
+	if name == "link" {
+		flags.BoolVar(&opts.noWatch, "no-watch", false, "Exit after the initial sync instead of watching for changes")
+		flags.DurationVar(&opts.quietPeriod, "quiet-period", 0, "Send changes once no file has changed for this long (default 5s)")
+		flags.DurationVar(&opts.maxWait, "max-wait", 0, "Send changes at the latest this long after the first one (default 30s)")
+		flags.IntVar(&opts.maxBatchFiles, "max-batch-files", 0, "Send changes straight away once this many files have changed")
+		flags.Int64Var(&opts.maxBatchBytes, "max-batch-bytes", 0, "Send changes straight away once this many bytes of files have changed")
+		flags.StringVar(&opts.watchMode, "watch-mode", "", "How to find changes: auto, or poll for network filesystems (default auto)")
+		flags.DurationVar(&opts.pollInterval, "poll-interval", 0, "How often to check for changes when polling (default 2s)")
+	} else {
+		flags.BoolVar(&opts.full, "full", false, "Upload every file instead of only the files changed since the last sync")
+	}
+	flags.Parse(args)
 
-	if tokenErr != nil {
-		fmt.Printf("Error getting token: %v\n", tokenErr)
+	if flags.NArg() > 0 {
+		fmt.Printf("Unexpected argument %s\n", flags.Arg(0))
+		fmt.Println("Use 'mordecai --help' for usage information.")
+		os.Exit(exitUsage)
 	}
 
-	// Get all repote spaces
-	workspaceId, workspaceName, err := getWorkspaces(token)
+	if opts.quietPeriod < 0 || opts.maxWait < 0 || opts.maxBatchFiles < 0 || opts.maxBatchBytes < 0 || opts.pollInterval < 0 {
+		fmt.Println("--quiet-period, --max-wait, --max-batch-files, --max-batch-bytes and --poll-interval can't be negative")
+		os.Exit(exitUsage)
+	}
+	if opts.watchMode != "" && opts.watchMode != watchModeAuto && opts.watchMode != watchModePoll {
+		fmt.Println("--watch-mode must be auto or poll")
+		os.Exit(exitUsage)
+	}
+
+	assumeYes = opts.yes
+
+	settings, err := useProfile(opts.profile, false)
 	if err != nil {
-		fmt.Printf("Error getting workspaces: %v\n", err)
-		return
+		fmt.Println(err)
+		os.Exit(exitUsage)
+	}
+	if err := setEndpointFlags(opts.apiURL, opts.webURL); err != nil {
+		fmt.Println(err)
+		os.Exit(exitUsage)
+	}
+	if opts.space == "" {
+		opts.space = settings.Space
+	}
+	return opts
+}
+
+// applyWatchFlags overrides the watcher batching of cfg with the flags
+// that were given
+func (opts linkOptions) applyWatchFlags(cfg *Config) {
+	if opts.quietPeriod > 0 {
+		cfg.watchQuietPeriod = opts.quietPeriod
+	}
+	if opts.maxWait > 0 {
+		cfg.watchMaxWait = opts.maxWait
+	}
+	if opts.maxBatchFiles > 0 {
+		cfg.watchMaxFiles = opts.maxBatchFiles
+	}
+	if opts.maxBatchBytes > 0 {
+		cfg.watchMaxBytes = opts.maxBatchBytes
+	}
+	if opts.watchMode != "" {
+		cfg.watchMode = opts.watchMode
+	}
+	if opts.pollInterval > 0 {
+		cfg.watchPollInterval = opts.pollInterval
+	}
+}
+
+// linkSession is a repository resolved against a remote space
+type linkSession struct {
+	workspaceId   string
+	workspaceName string
+	repoName      string
+	repoId        string
+	currentDir    string
+	files         []string
+}
 
+// openLinkSession authenticates, picks the space and repository and reads
+// the files to sync from the current directory
+func openLinkSession(ctx context.Context, opts linkOptions) (linkSession, error) {
+	var session linkSession
+
+	// Log in now rather than halfway through picking a space
+	if _, err := activeToken.current(ctx); err != nil {
+		return session, err
+	}
+
+	// Get all repote spaces
+	var err error
+	session.workspaceId, session.workspaceName, err = getWorkspaces(ctx, opts.space)
+	if err != nil {
+		return session, fmt.Errorf("Error getting workspaces: %w", err)
 	}
+
 	// Get name of the context
-	repoName, repoId, err := linkRepo(token, workspaceId)
+	session.repoName, session.repoId, err = linkRepo(ctx, session.workspaceId, opts.repo)
+	if err != nil {
+		return session, fmt.Errorf("Error linking repository: %w", err)
+	}
 
-	currentDir, err := os.Getwd()
+	session.currentDir, err = os.Getwd()
 	if err != nil {
-		fmt.Printf("Error getting current directory: %v\n", err)
-		return
+		return session, fmt.Errorf("Error getting current directory: %v", err)
 	}
 
-	var dir, dirErr = readDir(currentDir)
-	if dirErr != nil {
-		fmt.Printf("Error reading current directory: %v\n", err)
+	session.files, err = readDir(session.currentDir, opts.ignorePatterns)
+	if err != nil {
+		return session, fmt.Errorf("Error reading current directory: %v", err)
 	}
 
-	var dirContent, dirContentErr = getFileContents(dir)
-	if dirContentErr != nil {
-		fmt.Printf("Error reading current directory: %v\n", err)
+	if head, _, ok := readGitHead(session.currentDir); ok {
+		activeGitHead.Store(&head)
 	}
 
-	err = showLoadingAnimation("Initialising repository...", func() error {
-		var sendErr error
-		repoId, sendErr = sendDataToServer(dirContent, token, workspaceId, repoName, repoId, false)
-		return sendErr
-	})
+	return session, nil
+}
 
+func (s linkSession) sync(ctx context.Context, forceFull bool) (syncResult, error) {
+	result, err := syncRepository(ctx, s.currentDir, s.files, s.workspaceId, s.repoName, s.repoId, forceFull)
+	if errors.Is(err, context.Canceled) {
+		// Only whole batches are recorded in the manifest, so the next
+		// sync picks up where this one stopped
+		return result, fmt.Errorf("Sync interrupted after %d batches, run it again to send the rest: %w", result.Batches, err)
+	}
 	if err != nil {
-		fmt.Println("Error sending data to server.")
-		fmt.Println(err)
-		return
+		return result, fmt.Errorf("Error sending data to server.\n%w", err)
+	}
+	printSkippedFiles(result.Skipped)
+	return result, nil
+}
+
+func linkCommand(ctx context.Context, opts linkOptions) error {
+	session, err := openLinkSession(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	result, err := session.sync(ctx, false)
+	if err != nil {
+		return err
 	}
+	session.repoId = result.ContextId
 
-	fmt.Printf("\033[1;32m✓ Syncing local repository \033[1;36m%s\033[1;32m to remote space \033[1;36m%s\033[0m\n", repoName, workspaceName)
+	if !result.Full {
+		fmt.Printf("\033[1;32m✓ Uploaded %d changed, renamed %d and removed %d files since the last sync\033[0m\n", result.Uploaded, result.Renamed, result.Deleted)
+	}
+
+	if opts.noWatch {
+		fmt.Printf("\033[1;32m✓ Synced local repository \033[1;36m%s\033[1;32m to remote space \033[1;36m%s\033[0m\n", session.repoName, session.workspaceName)
+		return nil
+	}
+
+	fmt.Printf("\033[1;32m✓ Syncing local repository \033[1;36m%s\033[1;32m to remote space \033[1;36m%s\033[0m\n", session.repoName, session.workspaceName)
 	fmt.Println("\033[1;33m⚠ ALERT: Please leave this open while programming\033[0m")
-	fmt.Println("\n\033[1;32m✓ Tracked files:\033[0m")
 
-	root := printFileTree(dir, currentDir) // Add a watcher to the directory
-	initialModel := Model{root: root, cursor: 0}
-	initialModel.flattenTree()
+	if isInteractive() {
+		fmt.Println("\n\033[1;32m✓ Tracked files:\033[0m")
+
+		root := printFileTree(session.files, session.currentDir) // Add a watcher to the directory
+		initialModel := Model{root: root, cursor: 0}
+		initialModel.flattenTree()
+
+		p := tea.NewProgram(initialModel)
+		if _, err := p.Run(); err != nil {
+			fmt.Println("Error running program:", err)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Printf("\033[1;32m✓ Tracking %d files\033[0m\n", len(session.files))
+	}
+
+	err = watchDirectory(ctx, session.currentDir, session.workspaceId, session.repoName, session.repoId, opts.ignorePatterns)
+	if errors.Is(err, context.Canceled) {
+		// Stopped with Ctrl+C, which main turns into exit code 130
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Error setting up directory watcher: %v", err)
+	}
+
+	return nil
+}
+
+// pushCommand syncs the current tree once and returns the exit code
+func pushCommand(ctx context.Context, opts linkOptions) int {
+	session, err := openLinkSession(ctx, opts)
+	if err != nil {
+		fmt.Println(err)
+		if errors.Is(err, context.Canceled) {
+			return exitInterrupted
+		}
+		if isAuthFailure(err) {
+			return exitAuthFailure
+		}
+		return exitSyncFailure
+	}
+
+	result, err := session.sync(ctx, opts.full)
+	if err != nil {
+		fmt.Println(err)
+		if errors.Is(err, context.Canceled) {
+			return exitInterrupted
+		}
+		if isAuthFailure(err) {
+			return exitAuthFailure
+		}
+		return exitSyncFailure
+	}
 
-	p := tea.NewProgram(initialModel)
-	if _, err := p.Run(); err != nil {
-		fmt.Println("Error running program:", err)
+	if result.Full || result.Uploaded+result.Renamed+result.Deleted > 0 {
+		fmt.Printf("\033[1;32m✓ Pushed local repository \033[1;36m%s\033[1;32m to remote space \033[1;36m%s\033[0m\n", session.repoName, session.workspaceName)
+	} else {
+		fmt.Printf("\033[1;32m✓ Remote space \033[1;36m%s\033[1;32m is already up to date\033[0m\n", session.workspaceName)
+	}
+	fmt.Printf("  Files sent:  %d (%s)\n", result.Uploaded, formatBytes(result.Bytes))
+	fmt.Printf("  Renamed:     %d\n", result.Renamed)
+	fmt.Printf("  Deleted:     %d\n", result.Deleted)
+	fmt.Printf("  Context ID:  %s\n", result.ContextId)
+
+	return exitSuccess
+}
+
+// loadActiveConfig loads the config for the repository in the current
+// directory, exiting if a config file is invalid
+func loadActiveConfig() {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(currentDir)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+	config = cfg
+	httpClient = newHTTPClient(cfg)
+}
+
+func typesCommand() {
+	if len(config.sources) == 0 {
+		fmt.Println("Using the default file types (no config files found)")
+	} else {
+		fmt.Println("Using config from:")
+		for _, source := range config.sources {
+			fmt.Printf("  %s\n", source)
+		}
+	}
+
+	fmt.Println("\nExtensions:")
+	fmt.Printf("  %s\n", strings.Join(config.fileTypes.sortedExtensions(), " "))
+
+	if filenames := config.fileTypes.sortedFilenames(); len(filenames) > 0 {
+		fmt.Println("\nFile names:")
+		fmt.Printf("  %s\n", strings.Join(filenames, " "))
+	}
+}
+
+// logoutCommand deletes the token of the active profile, or of every
+// profile with --all, and returns the exit code
+func logoutCommand(args []string) int {
+	flags := flag.NewFlagSet("logout", flag.ExitOnError)
+	profileName := flags.String("profile", "", "Profile to log out of instead of the current one")
+	all := flags.Bool("all", false, "Log out of every profile")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Printf("Unexpected argument %s\n", flags.Arg(0))
+		fmt.Println("Use 'mordecai --help' for usage information.")
+		return exitUsage
+	}
+
+	names := []string{*profileName}
+	if *all {
+		profiles, err := loadProfiles()
+		if err != nil {
+			fmt.Println(err)
+			return exitSyncFailure
+		}
+		names = profiles.names()
+	}
+
+	loggedOut := 0
+	for _, name := range names {
+		if _, err := useProfile(name, false); err != nil {
+			fmt.Println(err)
+			return exitUsage
+		}
+
+		token, err := loadToken()
+		if err != nil {
+			fmt.Printf("Error loading token: %v\n", err)
+			return exitSyncFailure
+		}
+		if err := deleteToken(); err != nil {
+			fmt.Printf("Error deleting token: %v\n", err)
+			return exitSyncFailure
+		}
+		if len(token) > 0 {
+			fmt.Printf("Successfully logged out of profile %s!\n", activeProfile)
+			loggedOut++
+		}
+	}
+
+	if loggedOut == 0 {
+		fmt.Println("No active session found.")
+	}
+	return exitSuccess
+}
+
+// loginCommand logs in through the browser, or with a code entered on
+// another device with --device, and returns the exit code
+func loginCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	device := flags.Bool("device", false, "Log in by entering a code on another device")
+	profileName := flags.String("profile", "", "Profile to log in to instead of the current one")
+	space := flags.String("space", "", "Default space of the profile")
+	host := flags.String("host", "", "Mordecai site the account lives on")
+	apiURL := flags.String("api-url", "", "URL of the Mordecai API, for staging or self-hosted servers")
+	webURL := flags.String("web-url", "", "URL of the Mordecai website, for staging or self-hosted servers")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Printf("Unexpected argument %s\n", flags.Arg(0))
+		fmt.Println("Use 'mordecai --help' for usage information.")
+		return exitUsage
+	}
+
+	settings, err := useProfile(*profileName, true)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if err := setEndpointFlags(*apiURL, *webURL); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	// The server given here is the one the profile keeps using
+	if *space != "" {
+		settings.Space = *space
+	}
+	if *host != "" {
+		// URLs saved for the previous host don't apply to the new one
+		settings.Host, settings.APIURL, settings.WebURL = *host, "", ""
+	}
+	if *apiURL != "" {
+		settings.APIURL = *apiURL
+	}
+	if *webURL != "" {
+		settings.WebURL = *webURL
+	}
+	useProfileEndpoints(settings)
+	loadActiveConfig()
+
+	if *device {
+		_, err = authenticateDevice(ctx)
+	} else {
+		_, err = authenticate(ctx)
+	}
+	if err != nil {
+		fmt.Printf("Error authenticating: %v\n", err)
+		if errors.Is(err, context.Canceled) {
+			return exitInterrupted
+		}
+		return exitAuthFailure
+	}
 
-	err = watchDirectory(currentDir, workspaceId, repoName, repoId, token)
+	// Register the profile so profiles list and logout --all know it, with
+	// the settings given with the login for later runs
+	profiles, err := loadProfiles()
+	if err == nil {
+		profiles.Profiles[activeProfile] = settings
+		err = profiles.save()
+	}
 	if err != nil {
-		fmt.Printf("Error setting up directory watcher: %v\n", err)
-		return
+		fmt.Printf("Warning: %v\n", err)
 	}
 
+	fmt.Printf("\033[1;32m✓ Logged in to profile %s\033[0m\n", activeProfile)
+	return exitSuccess
 }
 
-func logoutCommand() {
-	token, tokenErr := loadToken()
+// authCommand runs the auth subcommands and returns the exit code
+func authCommand(args []string) int {
+	if len(args) == 0 || args[0] != "status" {
+		fmt.Println("Usage: mordecai auth status [--profile <name>]")
+		return exitUsage
+	}
+	flags := flag.NewFlagSet("auth status", flag.ExitOnError)
+	profileName := flags.String("profile", "", "Profile to show instead of the current one")
+	flags.Parse(args[1:])
+	if flags.NArg() > 0 {
+		fmt.Printf("Unexpected argument %s\n", flags.Arg(0))
+		return exitUsage
+	}
+	if _, err := useProfile(*profileName, false); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	fmt.Printf("Profile: %s\n", activeProfile)
 
-	if tokenErr != nil {
-		fmt.Printf("Error loading token: %v\n", tokenErr)
-		return
+	token, err := resolveToken()
+	if err != nil {
+		fmt.Printf("Error loading token: %v\n", err)
+		return exitAuthFailure
+	}
+	source := credentials.location()
+	if os.Getenv(tokenEnvVar) != "" {
+		source = tokenEnvVar
+	}
+	if token == "" {
+		fmt.Println("Not logged in. Run 'mordecai login' to log in.")
+		return exitAuthFailure
 	}
 
-	err := deleteToken()
+	if expiry, ok := tokenExpiry(token); ok && !expiry.After(time.Now()) {
+		fmt.Printf("Token in %s expired at %s. Run 'mordecai login' to log in again.\n", source, expiry.Local().Format(time.DateTime))
+		return exitAuthFailure
+	} else if ok {
+		fmt.Printf("Logged in, token stored in %s, expires at %s\n", source, expiry.Local().Format(time.DateTime))
+		return exitSuccess
+	}
+	fmt.Printf("Logged in, token stored in %s\n", source)
+	return exitSuccess
+}
+
+// profilesCommand lists, switches and removes profiles and returns the
+// exit code
+func profilesCommand(args []string) int {
+	usage := func() int {
+		fmt.Println("Usage: mordecai profiles list | use <name> | remove <name>")
+		return exitUsage
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	profiles, err := loadProfiles()
 	if err != nil {
-		fmt.Printf("Error deleting token: %v\n", err)
-		return
+		fmt.Println(err)
+		return exitSyncFailure
 	}
-	if len(token) > 0 {
-		fmt.Println("Successfully logged out!")
-		return
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		current := profiles.current()
+		if name := os.Getenv(profileEnvVar); name != "" {
+			current = name
+		}
+		for _, name := range profiles.names() {
+			marker := " "
+			if name == current {
+				marker = "*"
+			}
+			status := "not logged in"
+			if token, err := credentialStoreFor(name).load(); err == nil && token != "" {
+				status = "logged in"
+			}
+
+			settings := profiles.Profiles[name]
+			line := fmt.Sprintf("%s %-16s %s", marker, name, status)
+			if settings.Space != "" {
+				line += fmt.Sprintf(", space %s", settings.Space)
+			}
+			if settings.Host != "" {
+				line += fmt.Sprintf(", host %s", settings.Host)
+			}
+			if settings.APIURL != "" {
+				line += fmt.Sprintf(", API %s", settings.APIURL)
+			}
+			fmt.Println(line)
+		}
+
+	case args[0] == "use" && len(args) == 2:
+		name := args[1]
+		if err := validateProfileName(name); err != nil {
+			fmt.Println(err)
+			return exitUsage
+		}
+		if _, ok := profiles.Profiles[name]; !ok && name != defaultProfileName {
+			profiles.Profiles[name] = profile{}
+			fmt.Printf("Created profile %s\n", name)
+		}
+		profiles.Current = name
+		if err := profiles.save(); err != nil {
+			fmt.Println(err)
+			return exitSyncFailure
+		}
+		fmt.Printf("Now using profile %s\n", name)
+
+	case args[0] == "remove" && len(args) == 2:
+		name := args[1]
+		if name == defaultProfileName {
+			fmt.Println("The default profile can't be removed, use 'mordecai logout' to log out of it.")
+			return exitUsage
+		}
+		if _, ok := profiles.Profiles[name]; !ok {
+			fmt.Printf("No profile named %s\n", name)
+			return exitUsage
+		}
+		if err := credentialStoreFor(name).delete(); err != nil {
+			fmt.Printf("Error deleting token: %v\n", err)
+			return exitSyncFailure
+		}
+		delete(profiles.Profiles, name)
+		if profiles.Current == name {
+			profiles.Current = ""
+		}
+		if err := profiles.save(); err != nil {
+			fmt.Println(err)
+			return exitSyncFailure
+		}
+		fmt.Printf("Removed profile %s\n", name)
+
+	default:
+		return usage()
 	}
-	fmt.Println("No active session found.")
+	return exitSuccess
 }
 
 func versionCommand() {
@@ -181,7 +722,38 @@ func versionCommand() {
 func helpCommand() {
 	fmt.Println("Mordecai CLI Usage:")
 	fmt.Println("  mordecai link                   - Link your codebase with Mordecai")
+	fmt.Println("      --space <id|name>           - Sync to this space instead of choosing one")
+	fmt.Println("      --repo <name>               - Name of the repository in the space")
+	fmt.Println("      --no-update-check           - Skip checking for a newer version")
+	fmt.Println("      --yes                       - Answer yes to every prompt except updates")
+	fmt.Println("      --exclude <pattern>         - Don't sync files matching the pattern")
+	fmt.Println("      --include <pattern>         - Sync ignored files matching the pattern")
+	fmt.Println("      --no-watch                  - Exit after the initial sync")
+	fmt.Println("      --quiet-period <duration>   - Send changes once files stop changing for this long")
+	fmt.Println("      --max-wait <duration>       - Send changes at the latest this long after the first")
+	fmt.Println("      --max-batch-files <n>       - Send changes once this many files have changed")
+	fmt.Println("      --max-batch-bytes <n>       - Send changes once this many bytes have changed")
+	fmt.Println("      --watch-mode <auto|poll>    - Poll for changes, e.g. on NFS or Docker bind mounts")
+	fmt.Println("      --poll-interval <duration>  - How often to check for changes when polling")
+	fmt.Println("  mordecai push                   - Sync your codebase once and exit")
+	fmt.Println("      --full                      - Upload every file, not only changed ones")
+	fmt.Println("                                    (also accepts the link flags except --no-watch)")
+	fmt.Println("  mordecai types                  - List the file types that are synced")
+	fmt.Println("  mordecai login                  - Log in through the browser")
+	fmt.Println("      --device                    - Log in by entering a code on another device, e.g. over SSH")
+	fmt.Println("      --space <id|name>           - Default space of the profile")
+	fmt.Println("      --host <host>               - Mordecai site the account lives on")
+	fmt.Println("      --api-url <url>             - URL of the Mordecai API (also accepted by link and push)")
+	fmt.Println("      --web-url <url>             - URL of the Mordecai website (also accepted by link and push)")
+	fmt.Println("  mordecai auth status            - Show whether you are logged in and where the token is stored")
+	fmt.Println("  mordecai profiles list          - List your profiles, marking the current one")
+	fmt.Println("  mordecai profiles use <name>    - Switch to a profile, creating it if needed")
+	fmt.Println("  mordecai profiles remove <name> - Log out of a profile and forget its settings")
 	fmt.Println("  mordecai logout                 - Logout of your Mordecai account")
+	fmt.Println("      --all                       - Log out of every profile")
+	fmt.Println("")
+	fmt.Println("  link, push, login, logout and auth status accept --profile <name> to use")
+	fmt.Println("  another profile; MORDECAI_PROFILE does the same for every command.")
 	fmt.Println("  mordecai --help                 - Display this help message")
 	fmt.Println("  mordecai --version              - Display the version of Mordecai you have installed")
 	fmt.Println("  mordecai --installation-method  - Display the method you used to install mordecai")
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//                        _  __          _
+//  _ __ ___   __ _ _ __ (_)/ _| ___ ___| |_
+// | '_ ` _ \ / _` | '_ \| | |_ / _ \ __| __|
+// | | | | | | (_| | | | | |  _|  __\__ \ |_
+// |_| |_| |_|\__,_|_| |_|_|_|  \___|___/\__|
+//
+
+// manifestEntry records the state of a file at the time it was last synced
+type manifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"sha256"`
+}
+
+// syncManifest is the last successfully synced state of a repository,
+// keyed by the remote file path sent to the server
+type syncManifest struct {
+	Root      string                   `json:"root"`
+	SpaceId   string                   `json:"spaceId"`
+	ContextId string                   `json:"contextId"`
+	Files     map[string]manifestEntry `json:"files"`
+
+	path string
+}
+
+func getManifestFilePath(root string, workspaceId string) (string, error) {
+	return getRepoStateFilePath("manifests", root, workspaceId)
+}
+
+// getRepoStateFilePath returns the file in ~/.mordecai/<kind> that holds
+// state for a repository synced to a space
+func getRepoStateFilePath(kind string, root string, workspaceId string) (string, error) {
+	mordecaiPath, err := getMordecaiDir()
+	if err != nil {
+		return "", err
+	}
+	statePath := filepath.Join(mordecaiPath, kind)
+	if err := os.MkdirAll(statePath, 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s directory: %w", kind, err)
+	}
+
+	sum := sha256.Sum256([]byte(root + "\x00" + workspaceId))
+	return filepath.Join(statePath, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadManifest returns the manifest for the repository, or an empty one if
+// the repository has never been synced to this space
+func loadManifest(root string, workspaceId string) (*syncManifest, error) {
+	filePath, err := getManifestFilePath(root, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &syncManifest{
+		Root:    root,
+		SpaceId: workspaceId,
+		Files:   make(map[string]manifestEntry),
+		path:    filePath,
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return manifest, nil
+		}
+		return nil, fmt.Errorf("failed to load manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(data, manifest); err != nil {
+		// A corrupt manifest only costs us a full sync
+		return &syncManifest{Root: root, SpaceId: workspaceId, Files: make(map[string]manifestEntry), path: filePath}, nil
+	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]manifestEntry)
+	}
+
+	return manifest, nil
+}
+
+func (m *syncManifest) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	// Write to a temporary file first so an interrupted save never leaves a
+	// half written manifest behind
+	tmpPath := m.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	return nil
+}
+
+// scan builds the current state of the given files, reusing the previous
+// hash when a file's size and modification time are unchanged
+func (m *syncManifest) scan(files []string) (map[string]manifestEntry, map[string]string, error) {
+	entries := make(map[string]manifestEntry, len(files))
+	localPaths := make(map[string]string, len(files))
+
+	for _, filePath := range files {
+		remotePath, err := remoteFilePath(m.Root, filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entry, err := m.entryFor(remotePath, filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+
+		entries[remotePath] = entry
+		localPaths[remotePath] = filePath
+	}
+
+	return entries, localPaths, nil
+}
+
+func (m *syncManifest) entryFor(remotePath string, filePath string) (manifestEntry, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	if previous, ok := m.Files[remotePath]; ok {
+		if previous.Size == info.Size() && previous.ModTime.Equal(info.ModTime()) {
+			return previous, nil
+		}
+	}
+
+	hash, err := hashFile(filePath)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	return manifestEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}, nil
+}
+
+// diff returns the remote paths that were added or modified and the remote
+// paths that no longer exist compared to the manifest
+func (m *syncManifest) diff(current map[string]manifestEntry) ([]string, []string) {
+	var changed, deleted []string
+
+	for remotePath, entry := range current {
+		if previous, ok := m.Files[remotePath]; !ok || previous.Hash != entry.Hash {
+			changed = append(changed, remotePath)
+		}
+	}
+	for remotePath := range m.Files {
+		if _, ok := current[remotePath]; !ok {
+			deleted = append(deleted, remotePath)
+		}
+	}
+
+	return changed, deleted
+}
+
+// renames pairs added files with deleted files that had identical content,
+// so a moved file can be renamed remotely instead of uploaded again. The
+// paired paths are removed from changed and deleted.
+func (m *syncManifest) renames(current map[string]manifestEntry, changed []string, deleted []string) ([]FileRename, []string, []string) {
+	deletedByHash := make(map[string][]string)
+	for _, remotePath := range deleted {
+		hash := m.Files[remotePath].Hash
+		deletedByHash[hash] = append(deletedByHash[hash], remotePath)
+	}
+
+	var renamed []FileRename
+	paired := make(map[string]bool)
+	var remainingChanged []string
+	for _, remotePath := range changed {
+		_, existed := m.Files[remotePath]
+		candidates := deletedByHash[current[remotePath].Hash]
+		if existed || len(candidates) == 0 {
+			remainingChanged = append(remainingChanged, remotePath)
+			continue
+		}
+		oldPath := candidates[0]
+		deletedByHash[current[remotePath].Hash] = candidates[1:]
+		paired[oldPath] = true
+		renamed = append(renamed, FileRename{OldFilePath: oldPath, NewFilePath: remotePath})
+	}
+
+	var remainingDeleted []string
+	for _, remotePath := range deleted {
+		if !paired[remotePath] {
+			remainingDeleted = append(remainingDeleted, remotePath)
+		}
+	}
+
+	return renamed, remainingChanged, remainingDeleted
+}
+
+// apply updates the manifest after a batch of changes was accepted by the
+// server, using the entries the batch was built from
+func (m *syncManifest) apply(changes fileChanges, skipped []skippedFile, current map[string]manifestEntry) {
+	for _, remotePath := range changes.Deleted {
+		delete(m.Files, remotePath)
+	}
+	for _, rename := range changes.Renamed {
+		delete(m.Files, rename.OldFilePath)
+		m.Files[rename.NewFilePath] = current[rename.NewFilePath]
+	}
+	for _, file := range changes.Files {
+		m.Files[file.FilePath] = current[file.FilePath]
+	}
+	// Skipped files are left out so they are reconsidered next time
+	for _, file := range skipped {
+		delete(m.Files, file.Path)
+	}
+}
+
+// record updates the manifest after the given local files were uploaded,
+// with the state of the content that was sent rather than what is on disk
+// now, which may have changed since. A file not in sent was deleted or
+// moved away.
+func (m *syncManifest) record(files []string, sent map[string]manifestEntry) {
+	for _, filePath := range files {
+		remotePath, err := remoteFilePath(m.Root, filePath)
+		if err != nil {
+			continue
+		}
+		if entry, ok := sent[filePath]; ok {
+			m.Files[remotePath] = entry
+		} else {
+			delete(m.Files, remotePath)
+		}
+	}
+}
+
+// hashContent hashes content the way hashFile hashes a file
+func hashContent(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error hashing file %s: %v", filePath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// remoteFilePath converts a local path into the path the server knows the
+// file by, which is prefixed with the name of the repository directory
+func remoteFilePath(root string, filePath string) (string, error) {
+	relPath, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return "", fmt.Errorf("error getting relative path for %s: %v", filePath, err)
+	}
+	return filepath.Join(filepath.Base(root), relPath), nil
+}
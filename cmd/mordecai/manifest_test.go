@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestDiff(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	repoDir := t.TempDir()
+	writeFile := func(name string, content string) string {
+		path := filepath.Join(repoDir, name)
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		return path
+	}
+
+	kept := writeFile("kept.go", "package kept")
+	modified := writeFile("modified.go", "package modified")
+	removed := writeFile("removed.go", "package removed")
+
+	manifest, err := loadManifest(repoDir, "space-1")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %v", err)
+	}
+	if len(manifest.Files) != 0 {
+		t.Fatalf("new manifest has %d files, want 0", len(manifest.Files))
+	}
+
+	recordFromDisk(t, manifest, kept, modified, removed)
+	manifest.ContextId = "context-1"
+	if err := manifest.save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	writeFile("modified.go", "package modified // changed")
+	added := writeFile("added.go", "package added")
+	if err := os.Remove(removed); err != nil {
+		t.Fatalf("Failed to remove test file: %v", err)
+	}
+
+	reloaded, err := loadManifest(repoDir, "space-1")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %v", err)
+	}
+	if reloaded.ContextId != "context-1" {
+		t.Errorf("reloaded ContextId = %v, want context-1", reloaded.ContextId)
+	}
+
+	current, _, err := reloaded.scan([]string{kept, modified, added})
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+
+	changed, deleted := reloaded.diff(current)
+
+	base := filepath.Base(repoDir)
+	wantChanged := map[string]bool{
+		filepath.Join(base, "modified.go"): true,
+		filepath.Join(base, "added.go"):    true,
+	}
+	if len(changed) != len(wantChanged) {
+		t.Errorf("diff() changed = %v, want %v", changed, wantChanged)
+	}
+	for _, path := range changed {
+		if !wantChanged[path] {
+			t.Errorf("diff() reported unexpected change %v", path)
+		}
+	}
+
+	if len(deleted) != 1 || deleted[0] != filepath.Join(base, "removed.go") {
+		t.Errorf("diff() deleted = %v, want [%v]", deleted, filepath.Join(base, "removed.go"))
+	}
+}
+
+func TestManifestIsPerSpace(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	repoDir := t.TempDir()
+
+	manifest, err := loadManifest(repoDir, "space-1")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %v", err)
+	}
+	manifest.ContextId = "context-1"
+	if err := manifest.save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	other, err := loadManifest(repoDir, "space-2")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %v", err)
+	}
+	if other.ContextId != "" {
+		t.Errorf("manifest for another space has ContextId %v, want empty", other.ContextId)
+	}
+}
+
+func TestManifestRenames(t *testing.T) {
+	manifest := &syncManifest{Files: map[string]manifestEntry{
+		"repo/old.go":   {Hash: "moved"},
+		"repo/stale.go": {Hash: "stale"},
+		"repo/same.go":  {Hash: "same"},
+	}}
+	current := map[string]manifestEntry{
+		"repo/new.go":  {Hash: "moved"},
+		"repo/same.go": {Hash: "edited"},
+	}
+
+	changed, deleted := manifest.diff(current)
+	renamed, changed, deleted := manifest.renames(current, changed, deleted)
+
+	if len(renamed) != 1 || renamed[0].OldFilePath != "repo/old.go" || renamed[0].NewFilePath != "repo/new.go" {
+		t.Errorf("renames() renamed = %+v, want repo/old.go -> repo/new.go", renamed)
+	}
+	if len(changed) != 1 || changed[0] != "repo/same.go" {
+		t.Errorf("renames() changed = %v, want [repo/same.go]", changed)
+	}
+	if len(deleted) != 1 || deleted[0] != "repo/stale.go" {
+		t.Errorf("renames() deleted = %v, want [repo/stale.go]", deleted)
+	}
+}
+
+// recordFromDisk records files in the manifest as synced with their content
+// on disk
+func recordFromDisk(t *testing.T, manifest *syncManifest, files ...string) {
+	t.Helper()
+	sent := make(map[string]manifestEntry)
+	for _, filePath := range files {
+		remotePath, err := remoteFilePath(manifest.Root, filePath)
+		if err != nil {
+			t.Fatalf("remoteFilePath() error = %v", err)
+		}
+		entry, err := manifest.entryFor(remotePath, filePath)
+		if err != nil {
+			t.Fatalf("entryFor() error = %v", err)
+		}
+		sent[filePath] = entry
+	}
+	manifest.record(files, sent)
+}
+
+func TestManifestRecordsSentContent(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	repoDir := t.TempDir()
+	filePath := filepath.Join(repoDir, "main.go")
+	if err := os.WriteFile(filePath, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	manifest, err := loadManifest(repoDir, "space-1")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %v", err)
+	}
+	pending, _ := pendingFromQueue(map[string]queuedChange{filePath: {Op: queuedUpdate}})
+
+	// Saved again while the upload was in flight
+	if err := os.WriteFile(filePath, []byte("package main // saved during the upload"), 0666); err != nil {
+		t.Fatalf("Failed to update test file: %v", err)
+	}
+	manifest.record(pending.localPaths(), pending.sent)
+
+	current, _, err := manifest.scan([]string{filePath})
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	if changed, _ := manifest.diff(current); len(changed) != 1 {
+		t.Errorf("diff() = %v, the save the server never got should count as changed", changed)
+	}
+}
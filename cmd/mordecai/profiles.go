@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+//                   __ _ _
+//  _ __  _ __ ___  / _(_) | ___  ___
+// | '_ \| '__/ _ \| |_| | |/ _ \/ __|
+// | |_) | | | (_) |  _| | |  __/\__ \
+// | .__/|_|  \___/|_| |_|_|\___||___/
+// |_|
+//
+
+const (
+	defaultProfileName = "default"
+	profileEnvVar      = "MORDECAI_PROFILE"
+	profilesFileName   = "profiles.json"
+)
+
+// profileNamePattern keeps profile names usable as file names
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// profile holds the settings of one account. Its token is kept separately,
+// in the credential store for the profile.
+type profile struct {
+	// Space is the ID or name of the space link and push use when --space
+	// isn't given
+	Space string `json:"space,omitempty"`
+	// Host is the Mordecai site the account lives on, mordecaiapp.com if
+	// empty
+	Host string `json:"host,omitempty"`
+	// APIURL and WebURL are the server URLs given with --api-url and
+	// --web-url at login, for staging or self-hosted servers
+	APIURL string `json:"apiUrl,omitempty"`
+	WebURL string `json:"webUrl,omitempty"`
+}
+
+// profilesFile is the format of ~/.mordecai/profiles.json
+type profilesFile struct {
+	Current  string             `json:"current,omitempty"`
+	Profiles map[string]profile `json:"profiles"`
+}
+
+// activeProfile is the name of the profile this run uses
+var activeProfile = defaultProfileName
+
+func getProfilesFilePath() (string, error) {
+	mordecaiPath, err := getMordecaiDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mordecaiPath, profilesFileName), nil
+}
+
+func loadProfiles() (*profilesFile, error) {
+	profiles := &profilesFile{Profiles: make(map[string]profile)}
+
+	filePath, err := getProfilesFilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profiles, nil
+		}
+		return nil, fmt.Errorf("failed to load profiles: %w", err)
+	}
+	if err := json.Unmarshal(data, profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filePath, err)
+	}
+	if profiles.Profiles == nil {
+		profiles.Profiles = make(map[string]profile)
+	}
+	return profiles, nil
+}
+
+func (p *profilesFile) save() error {
+	filePath, err := getProfilesFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode profiles: %w", err)
+	}
+
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save profiles: %w", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("failed to save profiles: %w", err)
+	}
+	return nil
+}
+
+// names returns every known profile, always including the default one
+func (p *profilesFile) names() []string {
+	names := make(map[string]bool, len(p.Profiles)+1)
+	names[defaultProfileName] = true
+	for name := range p.Profiles {
+		names[name] = true
+	}
+	return sortedKeys(names)
+}
+
+// current returns the profile used when none is given on the command line
+// or in MORDECAI_PROFILE
+func (p *profilesFile) current() string {
+	if p.Current == "" {
+		return defaultProfileName
+	}
+	return p.Current
+}
+
+func validateProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// has reports whether a profile exists. The default one always does.
+func (p *profilesFile) has(name string) bool {
+	_, ok := p.Profiles[name]
+	return ok || name == defaultProfileName
+}
+
+// useProfile makes the named profile active for this run, or the one from
+// MORDECAI_PROFILE or profiles use if name is empty, and returns its
+// settings. Only login may pass create to start a new profile; everywhere
+// else a mistyped name is an error rather than a login nobody can see.
+func useProfile(name string, create bool) (profile, error) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return profile{}, err
+	}
+
+	if name == "" {
+		name = os.Getenv(profileEnvVar)
+	}
+	if name == "" {
+		name = profiles.current()
+	}
+	if err := validateProfileName(name); err != nil {
+		return profile{}, err
+	}
+	if !create && !profiles.has(name) {
+		return profile{}, fmt.Errorf("unknown profile %q: run 'mordecai login --profile %s' to create it", name, name)
+	}
+
+	activeProfile = name
+	credentials = credentialStoreFor(name)
+	settings := profiles.Profiles[name]
+	useProfileEndpoints(settings)
+	return settings, nil
+}
+
+// credentialStoreFor returns where the token of a profile is kept. The
+// default profile uses the locations from before profiles existed, so
+// existing logins keep working.
+func credentialStoreFor(name string) credentialStore {
+	user := "token"
+	if name != defaultProfileName {
+		user = "token:" + name
+	}
+	return &fallbackStore{
+		primary:  keyringStore{user: user},
+		fallback: fileStore{profile: name},
+	}
+}
+
+// getProfileTokenFilePath is the token file of a profile when no keyring
+// is available
+func getProfileTokenFilePath(name string) (string, error) {
+	if name == defaultProfileName {
+		return getTokenFilePath()
+	}
+
+	mordecaiPath, err := getMordecaiDir()
+	if err != nil {
+		return "", err
+	}
+	profilePath := filepath.Join(mordecaiPath, "profiles", name)
+	if err := os.MkdirAll(profilePath, 0700); err != nil {
+		return "", fmt.Errorf("failed to create profile directory: %w", err)
+	}
+	return filepath.Join(profilePath, "token"), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUseProfile(t *testing.T) {
+	homeDir := t.TempDir()
+	t.Setenv("HOME", homeDir)
+	t.Setenv(profileEnvVar, "")
+	defer func(name, host, apiURL, webURL string, store credentialStore) {
+		activeProfile, siteUrl, profileAPIURL, profileWebURL, credentials = name, host, apiURL, webURL, store
+	}(activeProfile, siteUrl, profileAPIURL, profileWebURL, credentials)
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		t.Fatalf("loadProfiles() error = %v", err)
+	}
+	profiles.Current = "work"
+	profiles.Profiles["work"] = profile{Space: "Backend", Host: "mordecai.example.com"}
+	profiles.Profiles["oss"] = profile{}
+	if err := profiles.save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		flag     string
+		env      string
+		expected string
+		space    string
+		host     string
+	}{
+		{name: "Current profile", expected: "work", space: "Backend", host: "mordecai.example.com"},
+		{name: "Environment variable", env: "oss", expected: "oss", host: defaultSiteUrl},
+		{name: "Flag wins over the environment", flag: "default", env: "oss", expected: "default", host: defaultSiteUrl},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(profileEnvVar, tt.env)
+			settings, err := useProfile(tt.flag, false)
+			if err != nil {
+				t.Fatalf("useProfile() error = %v", err)
+			}
+			if activeProfile != tt.expected || settings.Space != tt.space {
+				t.Errorf("useProfile() = %s with space %q, want %s with space %q", activeProfile, settings.Space, tt.expected, tt.space)
+			}
+			if store := credentials.(*fallbackStore).fallback.(fileStore); store.profile != tt.expected {
+				t.Errorf("credentials are for profile %s, want %s", store.profile, tt.expected)
+			}
+			if siteUrl != tt.host {
+				t.Errorf("siteUrl = %q, want %q", siteUrl, tt.host)
+			}
+		})
+	}
+
+	if _, err := useProfile("../escape", true); err == nil {
+		t.Error("useProfile() should reject a name that isn't a valid file name")
+	}
+
+	// Only login creates profiles, so a typo isn't taken for a new one
+	if _, err := useProfile("wrok", false); err == nil {
+		t.Error("useProfile() should reject a profile that doesn't exist")
+	}
+	t.Setenv(profileEnvVar, "wrok")
+	if _, err := useProfile("", false); err == nil {
+		t.Error("useProfile() should reject a MORDECAI_PROFILE that doesn't exist")
+	}
+	if _, err := useProfile("new", true); err != nil || activeProfile != "new" {
+		t.Errorf("useProfile() = %s, %v, want a new profile for login", activeProfile, err)
+	}
+
+	// Each profile has its own token file; the default keeps the old one
+	defaultPath, _ := getProfileTokenFilePath(defaultProfileName)
+	workPath, _ := getProfileTokenFilePath("work")
+	if defaultPath != filepath.Join(homeDir, ".mordecai", ".mordecai_token") {
+		t.Errorf("default token path = %s, want the path from before profiles", defaultPath)
+	}
+	if workPath != filepath.Join(homeDir, ".mordecai", "profiles", "work", "token") {
+		t.Errorf("work token path = %s", workPath)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+//  _   _ _ __ | | ___   __ _  __| |   __ _ _   _  ___ _   _  ___
+// | | | | '_ \| |/ _ \ / _` |/ _` |  / _` | | | |/ _ \ | | |/ _ \
+// | |_| | |_) | | (_) | (_| | (_| | | (_| | |_| |  __/ |_| |  __/
+//  \__,_| .__/|_|\___/ \__,_|\__,_|  \__, |\__,_|\___|\__,_|\___|
+//       |_|                             |_|
+
+// Bounds of the delay between attempts to upload a failed batch
+const (
+	retryBaseDelay = 2 * time.Second
+	retryMaxDelay  = 5 * time.Minute
+)
+
+// defaultProbeInterval is how often a queue waiting out a network failure
+// checks whether the server can be reached again, so uploads resume soon
+// after the network is back instead of at the end of the backoff
+const defaultProbeInterval = 5 * time.Second
+
+// Operations recorded in the upload queue
+const (
+	queuedUpdate = "update"
+	queuedDelete = "delete"
+	queuedRename = "rename"
+)
+
+// queuedChange is a change to one local path that hasn't reached the server.
+// Content is read when the queue is flushed, so it is always current.
+type queuedChange struct {
+	Op      string `json:"op"`
+	OldPath string `json:"oldPath,omitempty"`
+
+	// seq tells a flush whether the change was replaced while uploading
+	seq uint64
+}
+
+// uploadQueue holds watcher changes until the server has accepted them. It
+// is saved under ~/.mordecai/queues so nothing is lost if the network is
+// down or mordecai is restarted, and retries with exponential backoff.
+type uploadQueue struct {
+	mu sync.Mutex
+
+	filePath    string
+	root        string
+	workspaceId string
+	repoName    string
+	repoId      string
+
+	changes  map[string]queuedChange
+	seq      uint64
+	attempts int
+	flushing bool
+	paused   bool
+	probing  bool
+	retry    *time.Timer
+
+	// idle is signalled when a flush finishes
+	idle *sync.Cond
+
+	// upload sends a batch and reachable checks whether the server
+	// answers, both replaced in tests
+	upload        func(pending *pendingChanges) error
+	reachable     func() bool
+	probeInterval time.Duration
+}
+
+type queueFile struct {
+	ContextId string                  `json:"contextId"`
+	Changes   map[string]queuedChange `json:"changes"`
+}
+
+func openUploadQueue(ctx context.Context, root, workspaceId, repoName, repoId string) (*uploadQueue, error) {
+	filePath, err := getRepoStateFilePath("queues", root, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &uploadQueue{
+		filePath:    filePath,
+		root:        root,
+		workspaceId: workspaceId,
+		repoName:    repoName,
+		repoId:      repoId,
+		changes:     make(map[string]queuedChange),
+	}
+	q.idle = sync.NewCond(&q.mu)
+	q.probeInterval = defaultProbeInterval
+	q.reachable = func() bool { return serverReachable(ctx) }
+	q.upload = func(pending *pendingChanges) error {
+		return processUpdatedFiles(ctx, q.root, pending, q.workspaceId, q.repoId, q.repoName)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, fmt.Errorf("failed to load upload queue: %w", err)
+	}
+
+	// Changes queued for another context don't apply to this one
+	var saved queueFile
+	if err := json.Unmarshal(data, &saved); err == nil && saved.ContextId == repoId {
+		for filePath, change := range saved.Changes {
+			q.seq++
+			change.seq = q.seq
+			q.changes[filePath] = change
+		}
+	}
+
+	return q, nil
+}
+
+// clearUploadQueue drops the queue of a repository, after a full manifest
+// sync has brought the server up to date
+func clearUploadQueue(root string, workspaceId string) error {
+	filePath, err := getRepoStateFilePath("queues", root, workspaceId)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear upload queue: %w", err)
+	}
+	return nil
+}
+
+// enqueue merges a batch of watcher changes into the queue. Changes to the
+// same path are coalesced, so only the latest state of each file is sent.
+func (q *uploadQueue) enqueue(pending *pendingChanges) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, filePath := range sortedKeys(pending.deleted) {
+		// Deleting the target of a queued rename deletes the original
+		if existing, ok := q.changes[filePath]; ok && existing.Op == queuedRename {
+			delete(q.changes, filePath)
+			filePath = existing.OldPath
+		}
+		q.set(filePath, queuedChange{Op: queuedDelete})
+	}
+
+	for _, newPath := range sortedKeys(pending.renamed) {
+		oldPath := pending.renamed[newPath]
+		existing, ok := q.changes[oldPath]
+		delete(q.changes, oldPath)
+
+		switch {
+		case ok && existing.Op == queuedRename:
+			// Moved again before the first move was uploaded
+			q.set(newPath, queuedChange{Op: queuedRename, OldPath: existing.OldPath})
+		case ok && existing.Op == queuedUpdate:
+			// The server never had the old path, so send it as a new file
+			q.set(newPath, queuedChange{Op: queuedUpdate})
+		default:
+			q.set(newPath, queuedChange{Op: queuedRename, OldPath: oldPath})
+		}
+	}
+
+	for _, filePath := range sortedKeys(pending.updated) {
+		if existing, ok := q.changes[filePath]; ok && existing.Op == queuedRename {
+			q.set(filePath, existing)
+			continue
+		}
+		q.set(filePath, queuedChange{Op: queuedUpdate})
+	}
+
+	if err := q.saveLocked(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+func (q *uploadQueue) set(filePath string, change queuedChange) {
+	q.seq++
+	change.seq = q.seq
+	q.changes[filePath] = change
+}
+
+func (q *uploadQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.changes)
+}
+
+// flush uploads everything in the queue, split into requests that stay
+// within the batch limits of the config. Each request that goes through is
+// taken off the queue. On failure the rest is kept and another attempt is
+// scheduled with exponential backoff and jitter.
+func (q *uploadQueue) flush() error {
+	q.mu.Lock()
+	if q.flushing || q.paused || len(q.changes) == 0 {
+		q.mu.Unlock()
+		return nil
+	}
+	q.flushing = true
+	if q.retry != nil {
+		q.retry.Stop()
+		q.retry = nil
+	}
+	snapshot := make(map[string]queuedChange, len(q.changes))
+	for filePath, change := range q.changes {
+		snapshot[filePath] = change
+	}
+	q.mu.Unlock()
+
+	batches := planQueueBatches(snapshot, config.watchMaxFiles, watchBatchBytes(config))
+	var err, refused error
+	hasUnread := false
+	for i := 0; i < len(batches) && !q.isPaused(); i++ {
+		batch := make(map[string]queuedChange, len(batches[i]))
+		for _, filePath := range batches[i] {
+			batch[filePath] = snapshot[filePath]
+		}
+		pending, unread := pendingFromQueue(batch)
+		err = q.upload(pending)
+
+		if isAPIError(err, apiErrorPayloadTooLarge) && len(batches[i]) > 1 {
+			// The server's limit is lower than ours, so split the batch and
+			// try again
+			half := len(batches[i]) / 2
+			batches = slices.Replace(batches, i, i+1, batches[i][:half], batches[i][half:])
+			i--
+			continue
+		}
+		if isAPIError(err, apiErrorPayloadTooLarge) || isAPIError(err, apiErrorRejected) {
+			// Sending the same changes again won't help, so drop them and
+			// leave them to the full comparison the next link does
+			fmt.Printf("The server refused %d queued changes, they will be sent by the next 'mordecai link': %v\n", len(batch), err)
+			refused, err = err, nil
+		}
+		if err != nil {
+			break
+		}
+
+		q.remove(batch, unread)
+		hasUnread = hasUnread || len(unread) > 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.flushing = false
+	q.idle.Broadcast()
+
+	switch {
+	case q.paused:
+		// Whatever is left is sent once the queue is resumed
+		return err
+	case errors.Is(err, context.Canceled):
+		// Shutting down, the changes stay queued on disk
+		return err
+	case err != nil:
+		q.attempts++
+		delay := max(retryDelay(q.attempts), retryAfter(err))
+		fmt.Printf("Upload failed, retrying %d queued changes in %s: %v\n", len(q.changes), delay.Round(time.Second), err)
+		q.retry = time.AfterFunc(delay, func() { q.flush() })
+		if isAPIError(err, apiErrorNetwork) {
+			q.probeLocked()
+		}
+		return err
+	case hasUnread:
+		// Back off, an unreadable file is often still unreadable right away
+		q.attempts++
+		q.retry = time.AfterFunc(retryDelay(q.attempts), func() { q.flush() })
+	case len(q.changes) > 0:
+		// Changes that arrived during the upload go out straight away
+		q.attempts = 0
+		q.retry = time.AfterFunc(0, func() { q.flush() })
+	default:
+		q.attempts = 0
+	}
+	return refused
+}
+
+// probeLocked checks whether the server can be reached while the queue
+// waits to retry, and flushes as soon as it can. It stops once the retry
+// has happened, or the queue is stopped or paused.
+func (q *uploadQueue) probeLocked() {
+	if q.probing {
+		return
+	}
+	q.probing = true
+
+	go func() {
+		ticker := time.NewTicker(q.probeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			q.mu.Lock()
+			waiting := q.retry != nil && !q.paused && !q.flushing
+			if !waiting {
+				q.probing = false
+			}
+			q.mu.Unlock()
+			if !waiting {
+				return
+			}
+
+			if q.reachable() {
+				q.mu.Lock()
+				q.probing = false
+				q.mu.Unlock()
+				q.flush()
+				return
+			}
+		}
+	}()
+}
+
+// remove takes the changes of a request that went through off the queue.
+// Changes replaced during the upload stay, and so do files that couldn't
+// be read, as they weren't sent.
+func (q *uploadQueue) remove(sent map[string]queuedChange, unread map[string]bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for filePath, change := range sent {
+		if unread[filePath] {
+			continue
+		}
+		if current, ok := q.changes[filePath]; ok && current.seq == change.seq {
+			delete(q.changes, filePath)
+		}
+	}
+	if err := q.saveLocked(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// watchBatchBytes is the most file content one watcher request carries:
+// the watch maxBytes limit if it is set and lower than maxBatchBytes
+func watchBatchBytes(cfg *Config) int64 {
+	if cfg.watchMaxBytes > 0 && cfg.watchMaxBytes < cfg.maxBatchBytes {
+		return cfg.watchMaxBytes
+	}
+	return cfg.maxBatchBytes
+}
+
+// planQueueBatches splits queued changes into requests of at most maxFiles
+// changes (no limit if zero) and maxBytes of file content, by the current
+// size of each file. Deletes and renames go first, so a path that was
+// moved away is freed before a new file at that path is sent. A file
+// larger than maxBytes gets a request of its own.
+func planQueueBatches(changes map[string]queuedChange, maxFiles int, maxBytes int64) [][]string {
+	var ordered []string
+	for _, op := range []string{queuedDelete, queuedRename, queuedUpdate} {
+		for _, filePath := range sortedKeys(changes) {
+			if changes[filePath].Op == op {
+				ordered = append(ordered, filePath)
+			}
+		}
+	}
+
+	var batches [][]string
+	var batch []string
+	var batchBytes int64
+	for _, filePath := range ordered {
+		var size int64
+		if changes[filePath].Op != queuedDelete {
+			if info, err := os.Stat(filePath); err == nil {
+				size = info.Size()
+			}
+		}
+		if len(batch) > 0 && (maxFiles > 0 && len(batch) >= maxFiles || batchBytes+size > maxBytes) {
+			batches = append(batches, batch)
+			batch, batchBytes = nil, 0
+		}
+		batch = append(batch, filePath)
+		batchBytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// clear drops every queued change, once a resync of the whole working
+// tree has sent them
+func (q *uploadQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.changes = make(map[string]queuedChange)
+	q.attempts = 0
+	if q.retry != nil {
+		q.retry.Stop()
+		q.retry = nil
+	}
+	if err := q.saveLocked(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// pause stops the queue from uploading and waits for an upload in flight
+// to finish, so a resync of the working tree doesn't race it for the same
+// context and manifest. resume lets the queue upload again.
+func (q *uploadQueue) pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+	if q.retry != nil {
+		q.retry.Stop()
+		q.retry = nil
+	}
+	for q.flushing {
+		q.idle.Wait()
+	}
+}
+
+func (q *uploadQueue) resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+}
+
+func (q *uploadQueue) isPaused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.paused
+}
+
+// stop cancels any scheduled retry. Queued changes stay on disk.
+func (q *uploadQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.retry != nil {
+		q.retry.Stop()
+		q.retry = nil
+	}
+}
+
+func (q *uploadQueue) saveLocked() error {
+	if len(q.changes) == 0 {
+		if err := os.Remove(q.filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to save upload queue: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(queueFile{ContextId: q.repoId, Changes: q.changes})
+	if err != nil {
+		return fmt.Errorf("failed to encode upload queue: %w", err)
+	}
+	tmpPath := q.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save upload queue: %w", err)
+	}
+	if err := os.Rename(tmpPath, q.filePath); err != nil {
+		return fmt.Errorf("failed to save upload queue: %w", err)
+	}
+	return nil
+}
+
+// pendingFromQueue rebuilds a batch from queued changes, reading the
+// current content of every file. A file that no longer exists is deleted,
+// and so is the remote copy of one that is now binary or too large. Files
+// that can't be read for any other reason are left out and returned as
+// unread, so they stay queued.
+func pendingFromQueue(changes map[string]queuedChange) (*pendingChanges, map[string]bool) {
+	pending := newPendingChanges()
+	unread := make(map[string]bool)
+
+	for _, filePath := range sortedKeys(changes) {
+		change := changes[filePath]
+		if change.Op == queuedDelete {
+			pending.deleted[filePath] = true
+			continue
+		}
+
+		// Stat before reading, so a save in between leaves the manifest
+		// with an older mtime than the file and it is hashed again later
+		info, statErr := os.Stat(filePath)
+		content, reason, err := readSyncableFile(filePath)
+		if err == nil && statErr != nil {
+			err = statErr
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				if change.Op == queuedRename {
+					filePath = change.OldPath
+				}
+				pending.deleted[filePath] = true
+			} else {
+				fmt.Printf("Error reading file %s: %v\n", filePath, err)
+				unread[filePath] = true
+			}
+			continue
+		}
+		if reason != "" {
+			fmt.Printf("\033[1;33m⚠ Skipping %s (%s)\033[0m\n", filePath, reason)
+			pending.skipped[filePath] = true
+			if change.Op == queuedRename {
+				// The server only has the file under its old path
+				pending.deleted[change.OldPath] = true
+			} else {
+				pending.deleted[filePath] = true
+			}
+			continue
+		}
+
+		if change.Op == queuedRename {
+			pending.renamed[filePath] = change.OldPath
+		}
+		pending.sent[filePath] = manifestEntry{Size: int64(len(content)), ModTime: info.ModTime(), Hash: hashContent(content)}
+		pending.updated[filePath] = FileContent{
+			FilePath:      filePath,
+			FileExtension: filepath.Ext(filePath),
+			DataChunks:    content,
+		}
+	}
+
+	return pending, unread
+}
+
+// retryDelay is the backoff before the given attempt, with up to 50% jitter
+// either way so many clients don't retry in lockstep
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(float64(delay) * (0.5 + rand.Float64()))
+}
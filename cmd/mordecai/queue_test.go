@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadQueueCoalesces(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	local := func(name string) string { return filepath.Join(root, name) }
+
+	queue, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-1")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+
+	first := newPendingChanges()
+	first.updated[local("edited.go")] = FileContent{}
+	first.updated[local("new.go")] = FileContent{}
+	first.deleted[local("a.go")] = true
+	first.renamed[local("b.go")] = local("a.go")
+	queue.enqueue(first)
+
+	second := newPendingChanges()
+	second.deleted[local("edited.go")] = true
+	second.deleted[local("b.go")] = true
+	second.renamed[local("moved.go")] = local("new.go")
+	queue.enqueue(second)
+
+	expected := map[string]queuedChange{
+		local("edited.go"): {Op: queuedDelete},
+		local("a.go"):      {Op: queuedDelete},
+		local("moved.go"):  {Op: queuedUpdate},
+	}
+	if len(queue.changes) != len(expected) {
+		t.Fatalf("queue has %v, want %v", queue.changes, expected)
+	}
+	for filePath, want := range expected {
+		got := queue.changes[filePath]
+		if got.Op != want.Op || got.OldPath != want.OldPath {
+			t.Errorf("queue[%v] = %+v, want %+v", filePath, got, want)
+		}
+	}
+
+	// The queue survives a restart of the same context only
+	reopened, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-1")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+	if reopened.len() != len(expected) {
+		t.Errorf("reopened queue has %d changes, want %d", reopened.len(), len(expected))
+	}
+	other, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-2")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+	if other.len() != 0 {
+		t.Errorf("queue for another context has %d changes, want 0", other.len())
+	}
+}
+
+func TestUploadQueueRetries(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	filePath := filepath.Join(root, "main.go")
+	if err := os.WriteFile(filePath, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	queue, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-1")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+	defer queue.stop()
+
+	var uploaded []*pendingChanges
+	fail := true
+	queue.upload = func(pending *pendingChanges) error {
+		if fail {
+			return errors.New("network is unreachable")
+		}
+		uploaded = append(uploaded, pending)
+		return nil
+	}
+
+	pending := newPendingChanges()
+	pending.updated[filePath] = FileContent{}
+	queue.enqueue(pending)
+
+	if err := queue.flush(); err == nil {
+		t.Fatal("flush() should report the failed upload")
+	}
+	if queue.len() != 1 || queue.attempts != 1 || queue.retry == nil {
+		t.Fatalf("after a failure the queue has %d changes, %d attempts, retry %v", queue.len(), queue.attempts, queue.retry)
+	}
+
+	// Content is read at flush time, so the upload carries the latest edit
+	if err := os.WriteFile(filePath, []byte("package main // edited"), 0666); err != nil {
+		t.Fatalf("Failed to update test file: %v", err)
+	}
+
+	fail = false
+	if err := queue.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if queue.len() != 0 || queue.attempts != 0 {
+		t.Errorf("after a success the queue has %d changes and %d attempts", queue.len(), queue.attempts)
+	}
+	if len(uploaded) != 1 || uploaded[0].updated[filePath].DataChunks != "package main // edited" {
+		t.Errorf("upload did not carry the latest content: %+v", uploaded)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 20; attempt++ {
+		delay := retryDelay(attempt)
+		if delay < retryBaseDelay/2 || delay > retryMaxDelay*3/2 {
+			t.Errorf("retryDelay(%d) = %v, out of bounds", attempt, delay)
+		}
+	}
+	// The fourth attempt waits 8x the base delay, minus at most half
+	if retryDelay(4) < 4*retryBaseDelay {
+		t.Errorf("retryDelay(4) = %v, should back off exponentially", retryDelay(4))
+	}
+}
+
+func TestPendingFromQueueDeletesSkippedFiles(t *testing.T) {
+	root := t.TempDir()
+	local := func(name string) string { return filepath.Join(root, name) }
+	if err := os.WriteFile(local("image.go"), []byte("\x00\x01binary"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(local("moved.go"), []byte("\x00\x01binary"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	pending, _ := pendingFromQueue(map[string]queuedChange{
+		local("image.go"): {Op: queuedUpdate},
+		local("moved.go"): {Op: queuedRename, OldPath: local("old.go")},
+	})
+
+	// The remote copy goes, under the path the server knows it by
+	for _, filePath := range []string{local("image.go"), local("old.go")} {
+		if !pending.deleted[filePath] {
+			t.Errorf("%s should be deleted, got %v", filePath, pending.deleted)
+		}
+	}
+	if len(pending.updated) != 0 || len(pending.renamed) != 0 {
+		t.Errorf("skipped files should not be uploaded: %v %v", pending.updated, pending.renamed)
+	}
+	if !pending.skipped[local("image.go")] || !pending.skipped[local("moved.go")] {
+		t.Errorf("skipped = %v, want both files", pending.skipped)
+	}
+}
+
+func TestUploadQueueKeepsUnreadableFiles(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	readable := filepath.Join(root, "main.go")
+	unreadable := filepath.Join(root, "locked.go")
+	if err := os.WriteFile(readable, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	// Reading a directory fails with an error other than not-exist
+	if err := os.Mkdir(unreadable, 0755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+
+	queue, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-1")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+	defer queue.stop()
+
+	var uploaded []*pendingChanges
+	queue.upload = func(pending *pendingChanges) error {
+		uploaded = append(uploaded, pending)
+		return nil
+	}
+
+	pending := newPendingChanges()
+	pending.updated[readable] = FileContent{}
+	pending.updated[unreadable] = FileContent{}
+	queue.enqueue(pending)
+
+	if err := queue.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if _, ok := queue.changes[unreadable]; !ok || queue.len() != 1 {
+		t.Fatalf("queue has %v, want only the unreadable file", queue.changes)
+	}
+	if queue.retry == nil {
+		t.Error("a retry should be scheduled for the unreadable file")
+	}
+
+	if err := os.Remove(unreadable); err != nil {
+		t.Fatalf("Failed to remove test directory: %v", err)
+	}
+	if err := os.WriteFile(unreadable, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := queue.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if queue.len() != 0 {
+		t.Errorf("queue has %v after the file became readable", queue.changes)
+	}
+	if len(uploaded) != 2 || uploaded[1].updated[unreadable].DataChunks != "package main" {
+		t.Errorf("the second upload should carry the file: %+v", uploaded)
+	}
+}
+
+func TestUploadQueueSplitsBatches(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	originalConfig := config
+	config = defaultConfig()
+	config.watchMaxFiles = 2
+	config.watchMaxBytes = 1000
+	defer func() { config = originalConfig }()
+
+	root := t.TempDir()
+	local := func(name string) string { return filepath.Join(root, name) }
+	for _, name := range []string{"a.go", "b.go", "c.go", "d.go"} {
+		if err := os.WriteFile(local(name), []byte("package main"), 0666); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	// Too large for the byte limit together with anything else
+	if err := os.WriteFile(local("big.go"), []byte(strings.Repeat("x", 995)), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	queue, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-1")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+	defer queue.stop()
+
+	var requests [][]string
+	queue.upload = func(pending *pendingChanges) error {
+		var paths []string
+		for _, filePath := range pending.localPaths() {
+			paths = append(paths, filepath.Base(filePath))
+		}
+		slices.Sort(paths)
+		// The server only takes a.go in a request of its own
+		if slices.Contains(paths, "a.go") && len(paths) > 1 {
+			return &apiError{Kind: apiErrorPayloadTooLarge, StatusCode: 413}
+		}
+		requests = append(requests, paths)
+		return nil
+	}
+
+	pending := newPendingChanges()
+	for _, name := range []string{"a.go", "b.go", "c.go", "d.go", "big.go"} {
+		pending.updated[local(name)] = FileContent{}
+	}
+	pending.deleted[local("gone.go")] = true
+	queue.enqueue(pending)
+
+	if err := queue.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	expected := [][]string{{"gone.go"}, {"a.go"}, {"b.go"}, {"big.go"}, {"c.go", "d.go"}}
+	if !slices.EqualFunc(requests, expected, slices.Equal[[]string]) {
+		t.Errorf("requests = %v, want %v", requests, expected)
+	}
+	if queue.len() != 0 {
+		t.Errorf("queue has %v after every request went through", queue.changes)
+	}
+}
+
+func TestUploadQueuePause(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	filePath := filepath.Join(root, "main.go")
+	if err := os.WriteFile(filePath, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	queue, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-1")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+	defer queue.stop()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	uploads := 0
+	queue.upload = func(pending *pendingChanges) error {
+		uploads++
+		started <- true
+		<-release
+		return nil
+	}
+
+	pending := newPendingChanges()
+	pending.updated[filePath] = FileContent{}
+	queue.enqueue(pending)
+	go queue.flush()
+	<-started
+
+	// pause waits for the upload in flight
+	paused := make(chan bool)
+	go func() {
+		queue.pause()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		t.Fatal("pause() returned while an upload was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-paused
+
+	queue.enqueue(pending)
+	if err := queue.flush(); err != nil || uploads != 1 {
+		t.Errorf("a paused queue uploaded: %d uploads, %v", uploads, err)
+	}
+	queue.clear()
+	queue.resume()
+	if queue.len() != 0 {
+		t.Errorf("queue has %v after clearing", queue.changes)
+	}
+}
+
+func TestUploadQueueFlushesWhenServerIsReachable(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	filePath := filepath.Join(root, "main.go")
+	if err := os.WriteFile(filePath, []byte("package main"), 0666); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	queue, err := openUploadQueue(context.Background(), root, "space-1", "repo", "ctx-1")
+	if err != nil {
+		t.Fatalf("openUploadQueue() error = %v", err)
+	}
+	defer queue.stop()
+	queue.probeInterval = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	online := false
+	uploaded := make(chan bool, 1)
+	queue.reachable = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return online
+	}
+	queue.upload = func(pending *pendingChanges) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !online {
+			return &apiError{Kind: apiErrorNetwork, Err: errors.New("network is unreachable")}
+		}
+		uploaded <- true
+		return nil
+	}
+
+	pending := newPendingChanges()
+	pending.updated[filePath] = FileContent{}
+	queue.enqueue(pending)
+	if err := queue.flush(); err == nil {
+		t.Fatal("flush() should report the failed upload")
+	}
+
+	mu.Lock()
+	online = true
+	mu.Unlock()
+
+	// The backoff is at least a second, so only the probe gets here first
+	select {
+	case <-uploaded:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the queue wasn't flushed once the server could be reached")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//                     _
+//  ___  ___  ___ _ __| |_ ___
+// / __|/ _ \/ __| '__| __/ __|
+// \__ \  __/ (__| |  | |_\__ \
+// |___/\___|\___|_|   \__|___/
+//
+
+// What to do with a file that looks like it contains a credential
+const (
+	secretActionBlock  = "block"
+	secretActionRedact = "redact"
+	secretActionWarn   = "warn"
+)
+
+const redactedSecret = "[REDACTED]"
+
+type secretRule struct {
+	name    string
+	pattern *regexp.Regexp
+	// group is the submatch holding the secret, 0 for the whole match
+	group int
+	// minEntropy rejects matches that look like placeholders
+	minEntropy float64
+}
+
+var secretRules = []secretRule{
+	{name: "AWS access key ID", pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA|AGPA|AIDA|AIPA|ANPA|ANVA|AROA)[0-9A-Z]{16}\b`)},
+	{name: "AWS secret access key", pattern: regexp.MustCompile(`(?i)aws.{0,20}?(?:secret|private).{0,20}?['"=:\s]([0-9a-zA-Z/+]{40})\b`), group: 1, minEntropy: 3.5},
+	{name: "GitHub token", pattern: regexp.MustCompile(`\b(?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,255}\b`)},
+	{name: "GitHub token", pattern: regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,255}\b`)},
+	{name: "Slack token", pattern: regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z-]{10,}\b`)},
+	{name: "Stripe secret key", pattern: regexp.MustCompile(`\b(?:sk|rk)_live_[0-9A-Za-z]{24,}\b`)},
+	{name: "Google API key", pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{name: "private key", pattern: regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY(?: BLOCK)?-----.*?(?:-----END [A-Z ]*PRIVATE KEY(?: BLOCK)?-----|\z)`)},
+	{name: "high-entropy secret", pattern: regexp.MustCompile(`(?i)(?:secret|token|passwd|password|api[_-]?key|access[_-]?key|private[_-]?key|client[_-]?secret)[\w.-]*["']?\s*[:=]\s*["']?([A-Za-z0-9+/=_\-.]{20,})`), group: 1, minEntropy: 4.0},
+}
+
+// secretFinding is a match of a secret rule in a file
+type secretFinding struct {
+	rule  string
+	line  int
+	start int
+	end   int
+	value string
+}
+
+// secretScanner applies the rules and the configured allowlists
+type secretScanner struct {
+	action        string
+	allowPaths    gitignore.Matcher
+	allowPatterns []*regexp.Regexp
+}
+
+func newSecretScanner(cfg *Config) *secretScanner {
+	scanner := &secretScanner{action: cfg.secretAction}
+
+	var ps []gitignore.Pattern
+	for _, pattern := range cfg.secretAllowPaths {
+		ps = append(ps, gitignore.ParsePattern(pattern, nil))
+	}
+	scanner.allowPaths = gitignore.NewMatcher(ps)
+
+	// loadConfig has already rejected patterns that don't compile
+	for _, pattern := range cfg.secretAllowPatterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			scanner.allowPatterns = append(scanner.allowPatterns, re)
+		}
+	}
+
+	return scanner
+}
+
+// scan returns the findings in content, in order of position
+func (s *secretScanner) scan(content string) []secretFinding {
+	var findings []secretFinding
+
+	for _, rule := range secretRules {
+		for _, match := range rule.pattern.FindAllStringSubmatchIndex(content, -1) {
+			start, end := match[2*rule.group], match[2*rule.group+1]
+			if start < 0 {
+				continue
+			}
+			value := content[start:end]
+			if rule.minEntropy > 0 && shannonEntropy(value) < rule.minEntropy {
+				continue
+			}
+			if s.allowed(value) {
+				continue
+			}
+			findings = append(findings, secretFinding{
+				rule:  rule.name,
+				line:  strings.Count(content[:start], "\n") + 1,
+				start: start,
+				end:   end,
+				value: value,
+			})
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool { return findings[i].start < findings[j].start })
+	return findings
+}
+
+func (s *secretScanner) allowed(value string) bool {
+	for _, re := range s.allowPatterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathAllowed reports whether a remote path is allowlisted. Remote paths
+// start with the repository directory, which patterns don't include.
+func (s *secretScanner) pathAllowed(remotePath string) bool {
+	parts := strings.Split(filepath.ToSlash(remotePath), "/")
+	if len(parts) > 1 {
+		parts = parts[1:]
+	}
+	return s.allowPaths.Match(parts, false)
+}
+
+// filter applies the configured action to every file with findings. It
+// returns the files that may be sent, with secrets redacted if configured,
+// and the files that were blocked.
+func (s *secretScanner) filter(files []FileContent) ([]FileContent, []skippedFile) {
+	var kept []FileContent
+	var blocked []skippedFile
+
+	for _, file := range files {
+		if s.pathAllowed(file.FilePath) {
+			kept = append(kept, file)
+			continue
+		}
+
+		findings := s.scan(file.DataChunks)
+		if len(findings) == 0 {
+			kept = append(kept, file)
+			continue
+		}
+
+		switch s.action {
+		case secretActionWarn:
+			for _, finding := range findings {
+				fmt.Printf("\033[1;33m⚠ %s:%d looks like a %s and will be uploaded\033[0m\n", file.FilePath, finding.line, finding.rule)
+			}
+			kept = append(kept, file)
+		case secretActionRedact:
+			for _, finding := range findings {
+				fmt.Printf("\033[1;33m⚠ %s:%d looks like a %s and was redacted\033[0m\n", file.FilePath, finding.line, finding.rule)
+			}
+			file.DataChunks = redactSecrets(file.DataChunks, findings)
+			kept = append(kept, file)
+		default:
+			blocked = append(blocked, skippedFile{
+				Path:   file.FilePath,
+				Reason: fmt.Sprintf("possible %s on line %d", findings[0].rule, findings[0].line),
+			})
+		}
+	}
+
+	return kept, blocked
+}
+
+// redactSecrets replaces every finding with a placeholder. Findings must be
+// sorted by position; overlapping findings are merged.
+func redactSecrets(content string, findings []secretFinding) string {
+	var out strings.Builder
+	last := 0
+	for _, finding := range findings {
+		if finding.start < last {
+			if finding.end > last {
+				last = finding.end
+			}
+			continue
+		}
+		out.WriteString(content[last:finding.start])
+		out.WriteString(redactedSecret)
+		last = finding.end
+	}
+	out.WriteString(content[last:])
+	return out.String()
+}
+
+// shannonEntropy is the average number of bits per character of s
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/charmbracelet/bubbles/list"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"io"
+	"net"
 	"net/http"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 //  ___  ___ _ ____   _____ _ __
@@ -26,24 +31,214 @@ import (
 //       |_|
 //
 
-func serverRequest[T any](endpoint string, body interface{}) (T, error) {
+// httpClient is shared by every request so connections are reused. It is
+// rebuilt when the config is loaded.
+var httpClient = newHTTPClient(config)
+
+// newHTTPClient returns a client that gives up on connecting after the
+// connect timeout and on a whole request after the request timeout. It
+// trusts the CA bundle and goes through the proxy from the config, if any.
+func newHTTPClient(cfg *Config) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.connectTimeout, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = cfg.connectTimeout
+	if cfg.rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: cfg.rootCAs}
+	}
+	if cfg.proxy != nil {
+		transport.Proxy = http.ProxyURL(cfg.proxy)
+	}
+	return &http.Client{Transport: transport, Timeout: cfg.requestTimeout}
+}
+
+// probeTimeout bounds the check of whether the server can be reached
+const probeTimeout = 3 * time.Second
+
+// serverReachable reports whether the API answers at all, whatever the
+// status, as a cheap check that the network is back
+func serverReachable(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, apiBaseURL(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// bodyTokenWarning is printed the first time the token has to be sent in
+// the request body
+var bodyTokenWarning sync.Once
+
+// serverRequest posts body to endpoint with the active token and decodes
+// the response into T. If the server rejects the token and a new one can
+// be had by logging in again, the request is sent once more with it.
+// Every failure is returned as an *apiError so callers can react to its
+// kind, except cancellation of ctx, which returns ctx's error, and not
+// being logged in, which returns errNotLoggedIn.
+func serverRequest[T any](ctx context.Context, endpoint string, body interface{}) (T, error) {
+	token, err := activeToken.current(ctx)
+	if err != nil {
+		var result T
+		return result, err
+	}
+
+	result, err := authorizedRequest[T](ctx, endpoint, token, body)
+	if isAPIError(err, apiErrorAuth) {
+		if token, refreshErr := activeToken.refresh(ctx, token); refreshErr == nil {
+			return authorizedRequest[T](ctx, endpoint, token, body)
+		}
+	}
+	return result, err
+}
+
+// authorizedRequest sends body with token, falling back to a token in the
+// body for servers that don't read the Authorization header. The header is
+// tried first every time, as a header lost once, such as to a proxy, says
+// nothing about the next request.
+func authorizedRequest[T any](ctx context.Context, endpoint string, token string, body interface{}) (T, error) {
+	result, err := postRequest[T](ctx, endpoint, token, body)
+	var apiErr *apiError
+	if token != "" && errors.As(err, &apiErr) && apiErr.Kind == apiErrorAuth && apiErr.Message == "No Access Token" {
+		// The server didn't see the header, so it may predate it
+		bodyTokenWarning.Do(func() {
+			fmt.Println("Warning: the server didn't receive the Authorization header, sending the token in the request body instead")
+		})
+		return postRequest[T](ctx, endpoint, token, bodyWithToken{body: body, token: token})
+	}
+	return result, err
+}
+
+// bodyWithToken is a request body with the token added as a "token" field,
+// the way servers without Authorization header support expect it
+type bodyWithToken struct {
+	body  interface{}
+	token string
+}
+
+// encode writes the body with the token field added before its closing
+// brace. Only the last bytes of the encoded body are held back, so it is
+// streamed like any other body.
+func (b bodyWithToken) encode(w io.Writer) error {
+	tokenField, err := json.Marshal(b.token)
+	if err != nil {
+		return err
+	}
+	tail := &objectTail{w: w}
+	if err := json.NewEncoder(tail).Encode(b.body); err != nil {
+		return err
+	}
+	if string(tail.held) != "}\n" {
+		return fmt.Errorf("request body is not a JSON object")
+	}
+	separator := ","
+	if tail.last == '{' {
+		separator = ""
+	}
+	_, err = fmt.Fprintf(w, "%s\"token\":%s}\n", separator, tokenField)
+	return err
+}
+
+// objectTail passes an encoded JSON object through, holding back its
+// closing brace and newline so more fields can be written before them
+type objectTail struct {
+	w    io.Writer
+	held []byte
+	last byte
+}
+
+func (t *objectTail) Write(p []byte) (int, error) {
+	// Everything but the last two bytes seen so far can go out
+	release := len(t.held) + len(p) - 2
+	if release <= 0 {
+		t.held = append(t.held, p...)
+		return len(p), nil
+	}
+
+	fromHeld := min(release, len(t.held))
+	fromP := release - fromHeld
+	if fromHeld > 0 {
+		if _, err := t.w.Write(t.held[:fromHeld]); err != nil {
+			return 0, err
+		}
+		t.last = t.held[fromHeld-1]
+	}
+	if fromP > 0 {
+		if _, err := t.w.Write(p[:fromP]); err != nil {
+			return 0, err
+		}
+		t.last = p[fromP-1]
+	}
+	t.held = append(append([]byte{}, t.held[fromHeld:]...), p[fromP:]...)
+	return len(p), nil
+}
+
+// encodeBody writes body as JSON, adding the token to it for servers that
+// read it from the body
+func encodeBody(w io.Writer, body interface{}) error {
+	if withToken, ok := body.(bodyWithToken); ok {
+		return withToken.encode(w)
+	}
+	return json.NewEncoder(w).Encode(body)
+}
+
+// postRequest sends a single request for serverRequest, with the token in
+// the Authorization header
+func postRequest[T any](ctx context.Context, endpoint string, token string, body interface{}) (T, error) {
 	var result T
 
-	jsonBody, err := json.Marshal(body)
+	// Stream the body as it is encoded instead of building it in memory
+	// first, as file batches can be large
+	bodyReader, bodyWriter := io.Pipe()
+	encodeErr := make(chan error, 1)
+	go func() {
+		err := encodeBody(bodyWriter, body)
+		encodeErr <- err
+		bodyWriter.CloseWithError(err)
+	}()
+	// Unblocks the encoder if the request fails before reading it all
+	defer bodyReader.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bodyReader)
 	if err != nil {
-		return result, fmt.Errorf("error marshaling request body: %v", err)
+		return result, &apiError{Kind: apiErrorRejected, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(jsonBody))
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return result, fmt.Errorf("error making request: %v", err)
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		// A body that can't be encoded fails the same way every time
+		select {
+		case err := <-encodeErr:
+			if err != nil {
+				return result, &apiError{Kind: apiErrorRejected, Err: fmt.Errorf("error encoding request: %w", err)}
+			}
+		default:
+		}
+		return result, &apiError{Kind: apiErrorNetwork, Err: err}
 	}
 	defer resp.Body.Close()
 
 	// Read the response body into a buffer
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return result, fmt.Errorf("error reading response: %v", err)
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		return result, &apiError{Kind: apiErrorNetwork, StatusCode: resp.StatusCode, Err: fmt.Errorf("error reading response: %v", err)}
 	}
 
 	// Try to decode error response first
@@ -51,54 +246,71 @@ func serverRequest[T any](endpoint string, body interface{}) (T, error) {
 		Success bool   `json:"success"`
 		Error   string `json:"error"`
 	}
-	if err := json.Unmarshal(respBody, &errorResp); err == nil {
-		if errorResp.Error == "No Access Token" || errorResp.Error == "Expired Token" {
-			authenticate()
-			return result, fmt.Errorf("authentication required: %s", errorResp.Error)
+	hasErrorResp := json.Unmarshal(respBody, &errorResp) == nil
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &apiError{
+			Kind:       errorKindForStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+		if hasErrorResp && errorResp.Error != "" {
+			apiErr.Message = errorResp.Error
+			if isAuthMessage(errorResp.Error) {
+				apiErr.Kind = apiErrorAuth
+			}
+		} else {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return result, apiErr
+	}
+
+	if hasErrorResp && errorResp.Error != "" {
+		kind := apiErrorRejected
+		if isAuthMessage(errorResp.Error) {
+			kind = apiErrorAuth
 		}
+		return result, &apiError{Kind: kind, StatusCode: resp.StatusCode, Message: errorResp.Error}
 	}
 
 	// Decode the actual response
 	if err := json.Unmarshal(respBody, &result); err != nil {
-		return result, fmt.Errorf("error decoding response: %v", err)
+		return result, &apiError{Kind: apiErrorServer, StatusCode: resp.StatusCode, Err: fmt.Errorf("error decoding response: %v", err)}
 	}
 
 	return result, nil
 }
 
-func getWorkspaces(token string) (string, string, error) {
+func getWorkspaces(ctx context.Context, space string) (string, string, error) {
 	fmt.Println("Fetching available workspaces...")
-	endpointURL := fmt.Sprintf("https://api.%s/cli/spaces", siteUrl)
+	endpointURL := apiEndpoint("/cli/spaces")
 
 	type Workspace struct {
 		WorkspaceID   string `json:"spaceId"`
 		WorkspaceName string `json:"spaceName"`
 	}
 
-	requestBody := struct {
-		Token string `json:"token"`
-	}{
-		Token: token,
-	}
-
-	workspaces, err := serverRequest[[]Workspace](endpointURL, requestBody)
+	workspaces, err := serverRequest[[]Workspace](ctx, endpointURL, struct{}{})
 	if err != nil {
-		return "", "", fmt.Errorf("failed to fetch workspaces: %v", err)
+		return "", "", fmt.Errorf("failed to fetch workspaces: %w", err)
 	}
 
-	workspaceData := make([]struct {
-		WorkspaceID   string `json:"spaceId"`
-		WorkspaceName string `json:"spaceName"`
-	}, len(workspaces))
-
+	workspaceData := make([]workspace, len(workspaces))
 	for i, w := range workspaces {
-		workspaceData[i] = struct {
-			WorkspaceID   string `json:"spaceId"`
-			WorkspaceName string `json:"spaceName"`
-		}{
-			WorkspaceID:   w.WorkspaceID,
-			WorkspaceName: w.WorkspaceName,
+		workspaceData[i] = workspace{id: w.WorkspaceID, name: w.WorkspaceName}
+	}
+
+	// A space given on the command line skips the picker entirely
+	if space != "" {
+		selected, err := findWorkspace(workspaceData, space)
+		if err != nil {
+			return "", "", err
 		}
+		return selected.id, selected.name, nil
+	}
+
+	if !isInteractive() {
+		return "", "", fmt.Errorf("no terminal to choose a space in, pass --space <id|name>")
 	}
 
 	// Clear the screen and move cursor to top before showing workspace selection
@@ -128,6 +340,31 @@ func getWorkspaces(token string) (string, string, error) {
 	return selectedId, selectedName, nil
 }
 
+// findWorkspace matches a space by ID, or by name if no ID matches
+func findWorkspace(workspaces []workspace, space string) (workspace, error) {
+	for _, w := range workspaces {
+		if w.id == space {
+			return w, nil
+		}
+	}
+
+	var matches []workspace
+	for _, w := range workspaces {
+		if strings.EqualFold(w.name, space) {
+			matches = append(matches, w)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return workspace{}, fmt.Errorf("no space with ID or name %q", space)
+	case 1:
+		return matches[0], nil
+	default:
+		return workspace{}, fmt.Errorf("%d spaces are named %q, pass the space ID instead", len(matches), space)
+	}
+}
+
 var (
 	titleStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("#FAFAFA")).
@@ -143,7 +380,6 @@ var (
 				SetString("► ")
 )
 
-// DUPLICATED TYPE
 type workspace struct {
 	id   string
 	name string
@@ -190,13 +426,10 @@ func (m workspaceModel) View() string {
 
 var docStyle = lipgloss.NewStyle().Margin(1, 2)
 
-func newWorkspaceModel(workspaces []struct {
-	WorkspaceID   string `json:"spaceId"`
-	WorkspaceName string `json:"spaceName"`
-}) workspaceModel {
+func newWorkspaceModel(workspaces []workspace) workspaceModel {
 	items := make([]list.Item, len(workspaces))
 	for i, w := range workspaces {
-		items[i] = workspace{id: w.WorkspaceID, name: w.WorkspaceName}
+		items[i] = w
 	}
 
 	delegate := list.NewDefaultDelegate()
@@ -244,19 +477,21 @@ func extractRepoNameFromURL(url string) string {
 	return parts[len(parts)-1]
 }
 
-func linkRepo(token string, workspaceId string) (string, string, error) {
-	endpointURL := fmt.Sprintf("https://api.%s/cli/space-repositories", siteUrl)
-	currentRepoName, err := getRepoName()
+func linkRepo(ctx context.Context, workspaceId string, repoName string) (string, string, error) {
+	endpointURL := apiEndpoint("/cli/space-repositories")
 
-	if err != nil {
-		return "", "", fmt.Errorf("error getting the current repo name: %v", err)
+	currentRepoName := repoName
+	if currentRepoName == "" {
+		var err error
+		currentRepoName, err = getRepoName()
+		if err != nil {
+			return "", "", fmt.Errorf("error getting the current repo name: %v", err)
+		}
 	}
 
 	requestBody := struct {
-		Token       string `json:"token"`
 		WorkspaceId string `json:"spaceId"`
 	}{
-		Token:       token,
 		WorkspaceId: workspaceId,
 	}
 
@@ -265,9 +500,9 @@ func linkRepo(token string, workspaceId string) (string, string, error) {
 		RepoName string `json:"contextName"`
 	}
 
-	repos, err := serverRequest[[]Repository](endpointURL, requestBody)
+	repos, err := serverRequest[[]Repository](ctx, endpointURL, requestBody)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to fetch repositories: %v", err)
+		return "", "", fmt.Errorf("failed to fetch repositories: %w", err)
 	}
 	// Checks if current repo has been previously linked
 	for _, repo := range repos {
@@ -281,23 +516,35 @@ func linkRepo(token string, workspaceId string) (string, string, error) {
 	return selectedRepoName, selectedRepoId, nil
 }
 
-func sendDataToServer(files []FileContent, token string, workspaceId string, repoName string, repoId string, update bool) (string, error) {
-	endpointURL := fmt.Sprintf("https://api.%s/cli/chunk", siteUrl)
+func sendDataToServer(ctx context.Context, changes fileChanges, workspaceId string, repoName string, repoId string, update bool) (string, error) {
+	endpointURL := apiEndpoint("/cli/chunk")
+
+	files := changes.Files
+	if files == nil {
+		files = []FileContent{}
+	}
 
 	postData := struct {
-		Files       []FileContent `json:"files"`
-		Token       string        `json:"token"`
-		ContextId   string        `json:"contextId,omitempty"`
-		ContextName string        `json:"contextName"`
-		WorkspaceId string        `json:"spaceId,omitempty"`
-		Update      bool          `json:"update"`
+		Files        []FileContent `json:"files"`
+		DeletedFiles []string      `json:"deletedFiles,omitempty"`
+		RenamedFiles []FileRename  `json:"renamedFiles,omitempty"`
+		ContextId    string        `json:"contextId,omitempty"`
+		ContextName  string        `json:"contextName"`
+		WorkspaceId  string        `json:"spaceId,omitempty"`
+		Update       bool          `json:"update"`
+		Branch       string        `json:"branch,omitempty"`
+		Commit       string        `json:"commit,omitempty"`
 	}{
-		Files:       files,
-		Token:       token,
-		ContextId:   repoId,
-		ContextName: repoName,
-		WorkspaceId: workspaceId,
-		Update:      update,
+		Files:        files,
+		DeletedFiles: changes.Deleted,
+		RenamedFiles: changes.Renamed,
+		ContextId:    repoId,
+		ContextName:  repoName,
+		WorkspaceId:  workspaceId,
+		Update:       update,
+	}
+	if head := activeGitHead.Load(); head != nil && config.gitTagContext {
+		postData.Branch, postData.Commit = head.Branch, head.Commit
 	}
 
 	// Define the response structure
@@ -306,9 +553,9 @@ func sendDataToServer(files []FileContent, token string, workspaceId string, rep
 	}
 
 	// Use the serverRequest wrapper
-	response, err := serverRequest[Response](endpointURL, postData)
+	response, err := serverRequest[Response](ctx, endpointURL, postData)
 	if err != nil {
-		return "", fmt.Errorf("server request failed: %v", err)
+		return "", fmt.Errorf("server request failed: %w", err)
 	}
 
 	return response.ContextId, nil
@@ -1,6 +1,17 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestExtractRepoNameFromURL(t *testing.T) {
 	tests := []struct {
@@ -34,3 +45,231 @@ func TestExtractRepoNameFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestFindWorkspace(t *testing.T) {
+	workspaces := []workspace{
+		{id: "a1", name: "Backend"},
+		{id: "b2", name: "Frontend"},
+		{id: "c3", name: "Shared"},
+		{id: "d4", name: "shared"},
+	}
+
+	tests := []struct {
+		name     string
+		space    string
+		expected string
+		wantErr  bool
+	}{
+		{name: "Match by ID", space: "b2", expected: "b2"},
+		{name: "Match by name ignoring case", space: "backend", expected: "a1"},
+		{name: "Ambiguous name", space: "Shared", wantErr: true},
+		{name: "No match", space: "Mobile", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := findWorkspace(workspaces, tt.space)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findWorkspace() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && result.id != tt.expected {
+				t.Errorf("findWorkspace() = %v, want %v", result.id, tt.expected)
+			}
+		})
+	}
+}
+
+func TestServerRequestStreamsBody(t *testing.T) {
+	useToken(t, "token", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Files []FileContent `json:"files"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"contextId": "ctx-1", "count": len(body.Files)})
+	}))
+	defer server.Close()
+
+	files := make([]FileContent, 1000)
+	for i := range files {
+		files[i] = FileContent{FilePath: "repo/file.go", DataChunks: strings.Repeat("x", 1024)}
+	}
+
+	type Response struct {
+		ContextId string `json:"contextId"`
+		Count     int    `json:"count"`
+	}
+	response, err := serverRequest[Response](context.Background(), server.URL, struct {
+		Files []FileContent `json:"files"`
+	}{Files: files})
+	if err != nil {
+		t.Fatalf("serverRequest() error = %v", err)
+	}
+	if response.ContextId != "ctx-1" || response.Count != len(files) {
+		t.Errorf("serverRequest() = %+v, want ctx-1 with %d files", response, len(files))
+	}
+}
+
+func TestServerRequestTimeoutAndCancel(t *testing.T) {
+	useToken(t, "token", nil)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cfg := defaultConfig()
+	cfg.requestTimeout = 50 * time.Millisecond
+	defer func(previous *http.Client) { httpClient = previous }(httpClient)
+	httpClient = newHTTPClient(cfg)
+
+	_, err := serverRequest[map[string]string](context.Background(), server.URL, map[string]string{})
+	if !isAPIError(err, apiErrorNetwork) || !isRetryable(err) {
+		t.Errorf("serverRequest() error = %v, want a retryable network error after the timeout", err)
+	}
+
+	httpClient = newHTTPClient(defaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = serverRequest[map[string]string](ctx, server.URL, map[string]string{})
+	if !errors.Is(err, context.Canceled) || isRetryable(err) {
+		t.Errorf("serverRequest() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestServerRequestAuthorization(t *testing.T) {
+	useToken(t, "secret", nil)
+	// A server that predates the Authorization header only reads the body
+	legacy := false
+	var bodyTokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		bodyTokens = append(bodyTokens, body["token"])
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if legacy {
+			token = body["token"]
+		}
+		if token != "secret" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "No Access Token"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"spaceId": body["spaceId"]})
+	}))
+	defer server.Close()
+
+	request := map[string]string{"spaceId": "space-1"}
+	response, err := serverRequest[map[string]string](context.Background(), server.URL, request)
+	if err != nil || response["spaceId"] != "space-1" {
+		t.Fatalf("serverRequest() = %v, %v, want space-1", response, err)
+	}
+	if bodyTokens[0] != "" {
+		t.Errorf("serverRequest() sent the token in the body: %q", bodyTokens[0])
+	}
+
+	legacy = true
+	bodyTokens = nil
+	for i := 0; i < 2; i++ {
+		response, err = serverRequest[map[string]string](context.Background(), server.URL, request)
+		if err != nil || response["spaceId"] != "space-1" {
+			t.Fatalf("serverRequest() = %v, %v, want space-1 from the fallback", response, err)
+		}
+	}
+	// Every request tries the header first, and only that request falls
+	// back to the body
+	want := []string{"", "secret", "", "secret"}
+	if !slices.Equal(bodyTokens, want) {
+		t.Errorf("serverRequest() body tokens = %q, want %q", bodyTokens, want)
+	}
+
+	legacy = false
+	bodyTokens = nil
+	if _, err := serverRequest[map[string]string](context.Background(), server.URL, request); err != nil || !slices.Equal(bodyTokens, []string{""}) {
+		t.Errorf("serverRequest() body tokens = %q, %v, want the header alone once it works again", bodyTokens, err)
+	}
+}
+
+func TestServerRequestRetriesAfterLogin(t *testing.T) {
+	useToken(t, "expired", func(context.Context, string) (string, error) { return "fresh", nil })
+
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		tokens = append(tokens, token)
+		if token != "fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Expired Token"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"contextId": "ctx-1"})
+	}))
+	defer server.Close()
+
+	response, err := serverRequest[map[string]string](context.Background(), server.URL, map[string]string{})
+	if err != nil || response["contextId"] != "ctx-1" {
+		t.Fatalf("serverRequest() = %v, %v, want ctx-1 after logging in again", response, err)
+	}
+	if len(tokens) != 2 || tokens[0] != "expired" || tokens[1] != "fresh" {
+		t.Errorf("tokens sent = %q, want the expired token and then the fresh one", tokens)
+	}
+}
+
+func TestBodyWithToken(t *testing.T) {
+	tests := []struct {
+		name string
+		body interface{}
+		want string
+	}{
+		{name: "Empty object", body: struct{}{}, want: `{"token":"se\"cret"}`},
+		{name: "Fields", body: map[string]string{"spaceId": "space-1"}, want: `{"spaceId":"space-1","token":"se\"cret"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			if err := encodeBody(&buf, bodyWithToken{body: tt.body, token: `se"cret`}); err != nil {
+				t.Fatalf("encodeBody() error = %v", err)
+			}
+			if got := strings.TrimSpace(buf.String()); got != tt.want {
+				t.Errorf("encodeBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Byte by byte, as a writer may be handed the encoding in any pieces
+	var buf strings.Builder
+	tail := &objectTail{w: &buf}
+	for _, c := range []byte("{\"a\":1}\n") {
+		tail.Write([]byte{c})
+	}
+	if buf.String() != `{"a":1` || string(tail.held) != "}\n" || tail.last != '1' {
+		t.Errorf("objectTail wrote %q and held %q", buf.String(), tail.held)
+	}
+
+	if err := encodeBody(io.Discard, bodyWithToken{body: []string{"a"}, token: "secret"}); err == nil {
+		t.Error("encodeBody() should refuse a body that isn't an object")
+	}
+	if err := encodeBody(io.Discard, bodyWithToken{body: map[string]interface{}{"bad": make(chan int)}, token: "secret"}); err == nil {
+		t.Error("encodeBody() should return the encoding error")
+	}
+}
+
+func TestServerRequestEncodingError(t *testing.T) {
+	useToken(t, "secret", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	defer server.Close()
+
+	_, err := serverRequest[map[string]string](context.Background(), server.URL, map[string]interface{}{"bad": make(chan int)})
+	if !isAPIError(err, apiErrorRejected) {
+		t.Errorf("serverRequest() error = %v, want a rejected error", err)
+	}
+}
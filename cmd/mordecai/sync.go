@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+//  ___ _   _ _ __   ___
+// / __| | | | '_ \ / __|
+// \__ \ |_| | | | | (__
+// |___/\__, |_| |_|\___|
+//      |___/
+
+// maxSendAttempts is how often a batch is sent before a sync gives up on a
+// network or server error
+const maxSendAttempts = 3
+
+// syncResult summarises what a call to syncRepository sent to the server
+type syncResult struct {
+	ContextId string
+	Full      bool
+	Uploaded  int
+	Deleted   int
+	Renamed   int
+	Bytes     int64
+	Batches   int
+	Skipped   []skippedFile
+}
+
+// syncRepository brings the remote context in line with the given files.
+// The first sync of a repository to a space, or a forced sync, uploads
+// everything; later syncs only upload files added or modified since the
+// last successful sync and tell the server which files disappeared.
+//
+// Files are read and sent in batches of at most config.maxBatchBytes, so
+// memory use and request size stay bounded however large the repository
+// is. The manifest is saved after every batch, so an interrupted sync
+// resumes where it stopped. Cancelling ctx aborts the batch in flight.
+func syncRepository(ctx context.Context, currentDir string, files []string, workspaceId, repoName, repoId string, forceFull bool) (syncResult, error) {
+	result := syncResult{ContextId: repoId}
+
+	manifest, err := loadManifest(currentDir, workspaceId)
+	if err != nil {
+		return result, err
+	}
+
+	current, localPaths, err := manifest.scan(files)
+	if err != nil {
+		return result, fmt.Errorf("error scanning repository: %v", err)
+	}
+
+	// A manifest is only trusted for the context it was built against
+	result.Full = forceFull || repoId == "" || manifest.ContextId != repoId
+
+	var toUpload []string
+	var renamed []FileRename
+	var removed []string
+	if result.Full {
+		toUpload = sortedKeys(localPaths)
+	} else {
+		changed, deleted := manifest.diff(current)
+		sort.Strings(changed)
+		sort.Strings(deleted)
+		renamed, toUpload, removed = manifest.renames(current, changed, deleted)
+
+		if len(toUpload) == 0 && len(renamed) == 0 && len(removed) == 0 {
+			return result, clearUploadQueue(currentDir, workspaceId)
+		}
+	}
+
+	batches := planBatches(toUpload, current, config.maxBatchBytes)
+	scanner := newSecretScanner(config)
+	// Files the server refused as too large even when sent on their own
+	rejected := make(map[string]bool)
+
+	for i := 0; i < len(batches); i++ {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		var changes fileChanges
+		// Renames and deletes ride along with the first batch
+		if i == 0 {
+			changes.Renamed = renamed
+			changes.Deleted = append([]string(nil), removed...)
+		}
+
+		var batchPaths []string
+		var skipped, blocked []skippedFile
+		for _, remotePath := range batches[i] {
+			if rejected[remotePath] {
+				skipped = append(skipped, skippedFile{Path: remotePath, Reason: "rejected by the server as too large"})
+				continue
+			}
+			batchPaths = append(batchPaths, localPaths[remotePath])
+		}
+
+		var collected []skippedFile
+		changes.Files, collected, err = collectFileContents(currentDir, batchPaths)
+		if err != nil {
+			return result, err
+		}
+		changes.Files, blocked = scanner.filter(changes.Files)
+		skipped = append(append(skipped, collected...), blocked...)
+
+		// Skipped files are removed remotely if an earlier version was synced
+		for _, file := range skipped {
+			if _, synced := manifest.Files[file.Path]; synced && !result.Full {
+				changes.Deleted = append(changes.Deleted, file.Path)
+			}
+		}
+
+		// The first batch of a full sync always goes out, as it is what
+		// creates or replaces the context
+		if changes.isEmpty() && !(result.Full && i == 0) {
+			result.Skipped = append(result.Skipped, skipped...)
+			continue
+		}
+
+		message := "Initialising repository"
+		if !result.Full {
+			message = fmt.Sprintf("Syncing %d changed, %d renamed and %d deleted files", len(toUpload), len(changes.Renamed), len(changes.Deleted))
+		}
+		if len(batches) > 1 {
+			message += fmt.Sprintf(" (batch %d of %d)", i+1, len(batches))
+		}
+		message += "..."
+
+		// Only the first batch of a full sync replaces the context; every
+		// later batch adds to the context it created
+		update := !result.Full || i > 0
+		contextId, err := sendWithRetry(ctx, message, changes, workspaceId, repoName, result.ContextId, update)
+		if batch := batches[i]; isAPIError(err, apiErrorPayloadTooLarge) && (len(batch) > 1 || len(batch) == 1 && !rejected[batch[0]]) {
+			// The server's limit is lower than ours, so split the batch and
+			// try again, or give up on a file that is too large by itself
+			if len(batch) > 1 {
+				fmt.Println("Batch too large for the server, splitting it in two...")
+				batches = slices.Replace(batches, i, i+1, batch[:len(batch)/2], batch[len(batch)/2:])
+			} else {
+				rejected[batch[0]] = true
+			}
+			i--
+			continue
+		}
+		if err != nil {
+			if result.Batches > 0 {
+				return result, fmt.Errorf("batch %d of %d failed after %d succeeded: %w", i+1, len(batches), result.Batches, err)
+			}
+			return result, err
+		}
+		if contextId != "" {
+			result.ContextId = contextId
+		}
+
+		result.Batches++
+		result.Uploaded += len(changes.Files)
+		result.Deleted += len(changes.Deleted)
+		result.Renamed += len(changes.Renamed)
+		result.Skipped = append(result.Skipped, skipped...)
+		for _, file := range changes.Files {
+			result.Bytes += int64(len(file.DataChunks))
+		}
+
+		if result.Full && i == 0 {
+			manifest.Files = make(map[string]manifestEntry)
+		}
+		manifest.ContextId = result.ContextId
+		manifest.apply(changes, skipped, current)
+		if err := manifest.save(); err != nil {
+			// The upload succeeded, so the worst case is a full sync next time
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	// Anything the watcher queued before is covered by this sync
+	if err := clearUploadQueue(currentDir, workspaceId); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+
+	return result, nil
+}
+
+// sendWithRetry sends one batch, retrying failures that may pass on their
+// own. It waits as long as the server asked, and backs off otherwise.
+func sendWithRetry(ctx context.Context, message string, changes fileChanges, workspaceId, repoName, repoId string, update bool) (string, error) {
+	for attempt := 1; ; attempt++ {
+		var contextId string
+		err := showLoadingAnimation(message, func() error {
+			var sendErr error
+			contextId, sendErr = sendDataToServer(ctx, changes, workspaceId, repoName, repoId, update)
+			return sendErr
+		})
+		if err == nil || !isRetryable(err) || attempt == maxSendAttempts {
+			return contextId, err
+		}
+
+		delay := retryAfter(err)
+		if delay == 0 {
+			delay = retryDelay(attempt)
+		}
+		fmt.Printf("%v, retrying in %s...\n", err, delay.Round(time.Second))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// planBatches groups remote paths so the files in each group add up to at
+// most maxBytes. A file larger than maxBytes gets a batch of its own, where
+// the per-file limit decides whether it is sent. There is always at least
+// one batch.
+func planBatches(remotePaths []string, entries map[string]manifestEntry, maxBytes int64) [][]string {
+	batches := [][]string{nil}
+	var batchBytes int64
+
+	for _, remotePath := range remotePaths {
+		size := entries[remotePath].Size
+		last := len(batches) - 1
+		if len(batches[last]) > 0 && batchBytes+size > maxBytes {
+			batches = append(batches, nil)
+			last++
+			batchBytes = 0
+		}
+		batches[last] = append(batches[last], remotePath)
+		batchBytes += size
+	}
+
+	return batches
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanBatches(t *testing.T) {
+	entries := map[string]manifestEntry{
+		"repo/a.go":   {Size: 40},
+		"repo/b.go":   {Size: 50},
+		"repo/c.go":   {Size: 20},
+		"repo/big.js": {Size: 500},
+		"repo/d.go":   {Size: 10},
+	}
+
+	tests := []struct {
+		name     string
+		paths    []string
+		expected [][]string
+	}{
+		{
+			name:     "No files",
+			paths:    nil,
+			expected: [][]string{nil},
+		},
+		{
+			name:     "Fits in one batch",
+			paths:    []string{"repo/a.go", "repo/b.go"},
+			expected: [][]string{{"repo/a.go", "repo/b.go"}},
+		},
+		{
+			name:  "Split at the limit",
+			paths: []string{"repo/a.go", "repo/b.go", "repo/c.go", "repo/big.js", "repo/d.go"},
+			expected: [][]string{
+				{"repo/a.go", "repo/b.go"},
+				{"repo/c.go"},
+				{"repo/big.js"},
+				{"repo/d.go"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := planBatches(tt.paths, entries, 100)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("planBatches() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
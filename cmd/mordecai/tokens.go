@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 //  _        _
@@ -13,70 +20,200 @@ import (
 //  \__\___/|_|\_\___|_| |_|___/
 //
 
+// checkIfTokenIsValid reports whether a token is saved that hasn't expired
 func checkIfTokenIsValid() (bool, error) {
 	var token, err = loadToken()
 	if err != nil {
 		return false, err
 	}
 
-	if len(token) > 0 {
-		return true, nil
+	return len(token) > 0 && !tokenExpiresWithin(token, 0), nil
+}
+
+// tokenEnvVar overrides the saved login when set
+const tokenEnvVar = "MORDECAI_TOKEN"
+
+// resolveToken returns the token from MORDECAI_TOKEN if it is set, so CI
+// jobs can authenticate without a saved login, and the saved token otherwise
+func resolveToken() (string, error) {
+	if token := strings.TrimSpace(os.Getenv(tokenEnvVar)); token != "" {
+		return token, nil
 	}
 
-	return false, nil
+	token, err := loadToken()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(token), nil
 }
 
-func getTokenFilePath() (string, error) {
-	homeDir, err := os.UserHomeDir()
+// tokenRefreshWindow is how long before it expires a token is replaced, so
+// a long upload doesn't start with a token that runs out halfway
+const tokenRefreshWindow = 5 * time.Minute
+
+// tokenExpiry returns when a token expires if it is a JWT with an exp
+// claim. The signature isn't checked, that is up to the server.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
 	if err != nil {
-		return "", fmt.Errorf("failed to get home directory: %w", err)
+		return time.Time{}, false
 	}
-	mordecaiPath := filepath.Join(homeDir, ".mordecai")
-	if err := os.MkdirAll(mordecaiPath, 0700); err != nil {
-		return "", fmt.Errorf("failed to create .mordecai directory: %w", err)
+
+	var claims struct {
+		Exp float64 `json:"exp"`
 	}
-	return filepath.Join(mordecaiPath, ".mordecai_token"), nil
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(claims.Exp), 0), true
 }
 
-func saveToken(token string) error {
-	filePath, err := getTokenFilePath()
-	if err != nil {
-		return err
+// tokenExpiresWithin reports whether token is known to expire within d.
+// Tokens without an expiry are assumed valid until the server says not.
+func tokenExpiresWithin(token string, d time.Duration) bool {
+	expiry, ok := tokenExpiry(token)
+	return ok && time.Now().Add(d).After(expiry)
+}
+
+// canReauthenticate reports whether a rejected or expiring token can be
+// replaced by logging in again, which needs someone at a terminal and a
+// token that didn't come from MORDECAI_TOKEN
+func canReauthenticate() bool {
+	return os.Getenv(tokenEnvVar) == "" && isInteractive()
+}
+
+// tokenSource hands out the token requests are sent with and replaces it
+// when it expires or the server rejects it. It is shared by everything
+// that talks to the server, so only one login happens at a time.
+type tokenSource struct {
+	mu    sync.Mutex
+	token string
+
+	// login gets a new token, printing reason first, and gives up when ctx
+	// is cancelled. Replaced in tests.
+	login func(ctx context.Context, reason string) (string, error)
+}
+
+// activeToken is the token in use for this run
+var activeToken = &tokenSource{login: interactiveLogin}
+
+// interactiveLogin logs in when someone is there to do it, through the
+// browser or, over SSH, with a code entered on another device
+func interactiveLogin(ctx context.Context, reason string) (string, error) {
+	if !canReauthenticate() {
+		return "", errNotLoggedIn
+	}
+
+	// A sync that needs a new token is usually showing a spinner, which
+	// would draw over the prompts
+	resume := pauseLoadingAnimations()
+	defer resume()
+
+	if reason != "" {
+		fmt.Println(reason)
 	}
-	fmt.Println("New token saved")
 
-	err = os.WriteFile(filePath, []byte(token), 0600)
+	login := authenticate
+	if isSSHSession() {
+		login = authenticateDevice
+	}
+	token, err := login(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to save token: %w", err)
+		return "", fmt.Errorf("Error authenticating: %w", errors.Join(errNotLoggedIn, err))
 	}
-	return nil
+	return token, nil
 }
 
-func loadToken() (string, error) {
-	filePath, err := getTokenFilePath()
+// current returns the token to send. A missing token, or one about to
+// expire, is replaced by logging in first when that is possible.
+func (s *tokenSource) current(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == "" {
+		token, err := resolveToken()
+		if err != nil {
+			return "", fmt.Errorf("Error getting token: %v", err)
+		}
+		s.token = token
+	}
+
+	switch {
+	case s.token == "":
+		return s.loginLocked(ctx, "")
+	case tokenExpiresWithin(s.token, tokenRefreshWindow):
+		token, err := s.loginLocked(ctx, "Your session is about to expire, please log in again.")
+		if err == nil {
+			return token, nil
+		}
+		if tokenExpiresWithin(s.token, 0) {
+			return "", fmt.Errorf("Your token has expired: %w", err)
+		}
+		// Not expired yet, so carry on with it
+		return s.token, nil
+	default:
+		return s.token, nil
+	}
+}
+
+// refresh replaces a token the server rejected by logging in again. If
+// another request already replaced it, the newer token is returned
+// without a second login.
+func (s *tokenSource) refresh(ctx context.Context, rejected string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != rejected && s.token != "" {
+		return s.token, nil
+	}
+	return s.loginLocked(ctx, "Your session has expired, please log in again.")
+}
+
+func (s *tokenSource) loginLocked(ctx context.Context, reason string) (string, error) {
+	token, err := s.login(ctx, reason)
 	if err != nil {
 		return "", err
 	}
+	s.token = strings.TrimSpace(token)
+	return s.token, nil
+}
 
-	data, err := os.ReadFile(filePath)
+func getMordecaiDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil // No token file found, but not an error
-		}
-		return "", fmt.Errorf("failed to load token: %w", err)
+		return "", fmt.Errorf("failed to get home directory: %w", err)
 	}
-	return string(data), nil
+	mordecaiPath := filepath.Join(homeDir, ".mordecai")
+	if err := os.MkdirAll(mordecaiPath, 0700); err != nil {
+		return "", fmt.Errorf("failed to create .mordecai directory: %w", err)
+	}
+	return mordecaiPath, nil
 }
 
-func deleteToken() error {
-	filePath, err := getTokenFilePath()
+func getTokenFilePath() (string, error) {
+	mordecaiPath, err := getMordecaiDir()
 	if err != nil {
-		return err
+		return "", err
 	}
+	return filepath.Join(mordecaiPath, ".mordecai_token"), nil
+}
 
-	err = os.Remove(filePath)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete token: %w", err)
+func saveToken(token string) error {
+	if err := credentials.save(token); err != nil {
+		return err
 	}
+	fmt.Println("New token saved")
 	return nil
 }
+
+func loadToken() (string, error) {
+	return credentials.load()
+}
+
+func deleteToken() error {
+	return credentials.delete()
+}
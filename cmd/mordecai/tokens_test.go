@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestTokenOperations(t *testing.T) {
@@ -12,6 +17,10 @@ func TestTokenOperations(t *testing.T) {
 	os.Setenv("HOME", tmpHome)
 	defer os.Setenv("HOME", originalHome)
 
+	// Keep the test away from the real keyring
+	defer func(previous credentialStore) { credentials = previous }(credentials)
+	credentials = &memoryStore{}
+
 	t.Run("Test Save and Load Token", func(t *testing.T) {
 		testToken := "test-token-123"
 
@@ -60,3 +69,89 @@ func TestTokenOperations(t *testing.T) {
 		}
 	})
 }
+
+// useToken sends the requests in a test with token, and with login as the
+// way to replace it
+func useToken(t *testing.T, token string, login func(ctx context.Context, reason string) (string, error)) *tokenSource {
+	t.Helper()
+	if login == nil {
+		login = func(context.Context, string) (string, error) { return "", errNotLoggedIn }
+	}
+	previous := activeToken
+	activeToken = &tokenSource{token: token, login: login}
+	t.Cleanup(func() { activeToken = previous })
+	return activeToken
+}
+
+// testJWT returns an unsigned JWT that expires at exp
+func testJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"user","exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJIUzI1NiJ9." + payload + ".signature"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	if expiry, ok := tokenExpiry(testJWT(exp)); !ok || !expiry.Equal(exp) {
+		t.Errorf("tokenExpiry() = %v, %v, want %v", expiry, ok, exp)
+	}
+	if _, ok := tokenExpiry("test-token-123"); ok {
+		t.Error("tokenExpiry() should report no expiry for a token that isn't a JWT")
+	}
+
+	if tokenExpiresWithin(testJWT(exp), time.Minute) {
+		t.Error("a token valid for an hour shouldn't expire within a minute")
+	}
+	if !tokenExpiresWithin(testJWT(exp), 2*time.Hour) {
+		t.Error("a token valid for an hour should expire within two hours")
+	}
+	if tokenExpiresWithin("test-token-123", 2*time.Hour) {
+		t.Error("a token without an expiry should be assumed valid")
+	}
+}
+
+func TestTokenSourceRefresh(t *testing.T) {
+	logins := 0
+	ctx := context.Background()
+	login := func(context.Context, string) (string, error) {
+		logins++
+		return fmt.Sprintf("token-%d", logins), nil
+	}
+
+	// A token about to expire is replaced before it is used
+	source := useToken(t, testJWT(time.Now().Add(time.Minute)), login)
+	if token, err := source.current(ctx); err != nil || token != "token-1" {
+		t.Errorf("current() = %q, %v, want token-1", token, err)
+	}
+
+	// Requests that saw the same rejected token only log in once
+	for i := 0; i < 2; i++ {
+		if token, err := source.refresh(ctx, "token-1"); err != nil || token != "token-2" {
+			t.Errorf("refresh() = %q, %v, want token-2", token, err)
+		}
+	}
+	if logins != 2 {
+		t.Errorf("logins = %d, want 2", logins)
+	}
+
+	// Without a way to log in, an expiring token is used until it expires
+	expiring := testJWT(time.Now().Add(time.Minute))
+	source = useToken(t, expiring, nil)
+	if token, err := source.current(ctx); err != nil || token != expiring {
+		t.Errorf("current() = %q, %v, want the expiring token", token, err)
+	}
+	source = useToken(t, testJWT(time.Now().Add(-time.Minute)), nil)
+	if _, err := source.current(ctx); !errors.Is(err, errNotLoggedIn) {
+		t.Errorf("current() error = %v, want errNotLoggedIn for an expired token", err)
+	}
+
+	// A login waiting on the user gives up when the request is cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	source = useToken(t, testJWT(time.Now().Add(-time.Minute)), func(ctx context.Context, _ string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	if _, err := source.current(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("current() error = %v, want context.Canceled", err)
+	}
+}
@@ -2,31 +2,136 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sync"
 	"time"
 )
 
+// isInteractive reports whether mordecai is attached to a terminal and can
+// show prompts and pickers
+func isInteractive() bool {
+	for _, file := range []*os.File{os.Stdin, os.Stdout} {
+		info, err := file.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isSSHSession reports whether mordecai runs in an SSH session, where a
+// browser on this machine can't be opened by the user
+func isSSHSession() bool {
+	return os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != ""
+}
+
 func showLoadingAnimation(message string, process func() error) error {
-	done := make(chan bool)
+	// Spinner frames only clutter logs when there is no terminal
+	if !isInteractive() {
+		fmt.Println(message)
+		return process()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	animation := startLoadingAnimation(os.Stdout, message, ticker.C)
+	err := process()
+	animation.stop()
+	ticker.Stop()
+
+	return err
+}
+
+// loadingAnimation is a spinner on screen. It draws under animationMu, so
+// a prompt can pause it and be sure no frame lands in the middle.
+type loadingAnimation struct {
+	out     io.Writer
+	message string
+	paused  bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+var (
+	animationMu sync.Mutex
+	animations  = make(map[*loadingAnimation]bool)
+)
+
+// startLoadingAnimation draws the first frame straight away and the next
+// one on every tick
+func startLoadingAnimation(out io.Writer, message string, ticks <-chan time.Time) *loadingAnimation {
+	a := &loadingAnimation{out: out, message: message, done: make(chan struct{}), stopped: make(chan struct{})}
+	animationMu.Lock()
+	animations[a] = true
+	animationMu.Unlock()
 
 	go func() {
+		defer close(a.stopped)
 		frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
-		i := 0
-		for {
+		for i := 0; ; i = (i + 1) % len(frames) {
+			animationMu.Lock()
+			if !a.paused {
+				fmt.Fprintf(a.out, "\r%s %s", frames[i], a.message)
+			}
+			animationMu.Unlock()
+
 			select {
-			case <-done:
+			case <-a.done:
 				return
-			default:
-				fmt.Printf("\r%s %s", frames[i], message)
-				i = (i + 1) % len(frames)
-				time.Sleep(100 * time.Millisecond)
+			case <-ticks:
 			}
 		}
 	}()
+	return a
+}
 
-	err := process()
+func (a *loadingAnimation) stop() {
+	close(a.done)
+	<-a.stopped
 
-	done <- true
-	fmt.Print("\r\033[K")
+	animationMu.Lock()
+	defer animationMu.Unlock()
+	delete(animations, a)
+	if !a.paused {
+		fmt.Fprint(a.out, "\r\033[K")
+	}
+}
 
-	return err
+// pauseLoadingAnimations clears the spinners on screen and keeps them from
+// drawing, so a prompt such as a login can be shown. The returned function
+// starts them again. Spinners started in the meantime aren't affected.
+func pauseLoadingAnimations() (resume func()) {
+	animationMu.Lock()
+	defer animationMu.Unlock()
+
+	var paused []*loadingAnimation
+	for a := range animations {
+		if !a.paused {
+			a.paused = true
+			fmt.Fprint(a.out, "\r\033[K")
+			paused = append(paused, a)
+		}
+	}
+
+	return func() {
+		animationMu.Lock()
+		defer animationMu.Unlock()
+		for _, a := range paused {
+			a.paused = false
+		}
+	}
+}
+
+// formatBytes renders a byte count for humans, e.g. 1.5 KB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
 }
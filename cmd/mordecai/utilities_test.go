@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauseLoadingAnimations(t *testing.T) {
+	var out, inner strings.Builder
+	// Both builders are only touched under animationMu
+	written := func(b *strings.Builder) string {
+		animationMu.Lock()
+		defer animationMu.Unlock()
+		return b.String()
+	}
+	// A frame is drawn before the animation waits for the next tick, so
+	// once a second tick is taken the frame for the first has been drawn
+	ticks := make(chan time.Time)
+	drawFrame := func() {
+		ticks <- time.Now()
+		ticks <- time.Now()
+	}
+
+	outer := startLoadingAnimation(&out, "Updating files...", ticks)
+	drawFrame()
+	resume := pauseLoadingAnimations()
+	paused := written(&out)
+	if !strings.Contains(paused, "Updating files...") || !strings.HasSuffix(paused, "\r\033[K") {
+		t.Errorf("pausing should clear the spinner line, wrote %q", paused)
+	}
+
+	drawFrame()
+	if got := written(&out); got != paused {
+		t.Errorf("a paused spinner drew %q", strings.TrimPrefix(got, paused))
+	}
+
+	// A spinner started during the pause, such as the one of a login,
+	// still draws
+	login := startLoadingAnimation(&inner, "Waiting for the code to be approved...", nil)
+	login.stop()
+	if !strings.Contains(written(&inner), "Waiting for the code") {
+		t.Errorf("the login spinner didn't draw: %q", written(&inner))
+	}
+
+	resume()
+	drawFrame()
+	outer.stop()
+	if got := written(&out); !strings.Contains(strings.TrimPrefix(got, paused), "Updating files...") {
+		t.Errorf("the spinner didn't draw again after resuming: %q", got)
+	}
+	if len(animations) != 0 {
+		t.Errorf("stopped spinners are still tracked: %v", animations)
+	}
+}
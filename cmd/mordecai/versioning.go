@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
@@ -10,6 +11,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //                     _             _
@@ -19,9 +21,20 @@ import (
 //   \_/ \___|_|  |___/_|\___/|_| |_|_|_| |_|\__, |
 //                                           |___/
 
-func updateVersion() error {
-	latestVersion, err := getLatestVersion()
+// versionCheckTimeout bounds the request for the latest release
+const versionCheckTimeout = 5 * time.Second
+
+func updateVersion(ctx context.Context) error {
+	latestVersion, err := getLatestVersion(ctx)
 	if err == nil && compareVersions(latestVersion, version) > 0 {
+		// Without a terminal there is nobody to ask, so only mention it.
+		// --yes never installs an update: a scripted run shouldn't replace
+		// its own binary
+		if !isInteractive() || assumeYes {
+			fmt.Printf("Mordecai %s is available (installed: %s)\n", latestVersion, version)
+			return nil
+		}
+
 		m := VersionUpdateModel{
 			latestVersion:  latestVersion,
 			currentVersion: version,
@@ -68,6 +81,7 @@ func updateVersion() error {
 				}
 
 				fmt.Printf("\n%s\n%s\n", output, updateMessage)
+				fmt.Println("Run the command again to use the new version")
 				os.Exit(0)
 				return nil
 			})
@@ -92,7 +106,10 @@ func installationMethodCommand() (string, error) {
 	return "curl", nil
 }
 
-func getLatestVersion() (string, error) {
+func getLatestVersion(ctx context.Context) (string, error) {
+	// The update check shouldn't hold up the command it runs before
+	ctx, cancel := context.WithTimeout(ctx, versionCheckTimeout)
+	defer cancel()
 
 	// Check for the latest version
 	type Release struct {
@@ -100,9 +117,14 @@ func getLatestVersion() (string, error) {
 	}
 
 	// Make the HTTP GET request
-	resp, err := http.Get(githubAPI)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, githubAPI, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		fmt.Printf("Error fetching release: %v\n", err)
+		return "", err
 	}
 	defer resp.Body.Close()
 
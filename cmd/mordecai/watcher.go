@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"os"
@@ -19,106 +19,416 @@ import (
 
 // FIX THE MEMORY LEAKS
 
-func watchDirectory(directoryPath, workspaceId, repoName, repoId, token string) error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return fmt.Errorf("error creating watcher: %v", err)
+// renamePairWindow is how long after a Rename event a Create event is
+// treated as the other half of the same move
+const renamePairWindow = time.Second
+
+// pendingChanges collects watcher events between uploads, keyed by local path
+type pendingChanges struct {
+	updated map[string]FileContent
+	deleted map[string]bool
+	renamed map[string]string // new path -> old path
+
+	// sent is the state of the content read for each updated file, which
+	// the manifest records once the upload goes through
+	sent map[string]manifestEntry
+
+	// skipped files are binary or too large now. Their remote copy is in
+	// deleted, and they are kept out of the manifest.
+	skipped map[string]bool
+}
+
+func newPendingChanges() *pendingChanges {
+	return &pendingChanges{
+		updated: make(map[string]FileContent),
+		deleted: make(map[string]bool),
+		renamed: make(map[string]string),
+		sent:    make(map[string]manifestEntry),
+		skipped: make(map[string]bool),
 	}
+}
 
-	defer watcher.Close()
+// markUpdated records that filePath was written. Its content is read when
+// the batch is flushed from the upload queue, so the latest save is sent.
+func (p *pendingChanges) markUpdated(filePath string) {
+	delete(p.deleted, filePath)
+	p.updated[filePath] = FileContent{FilePath: filePath, FileExtension: filepath.Ext(filePath)}
+}
 
-	filesToUpdate := make([]FileContent, 0)
-	var timeoutTimer *time.Timer
+func (p *pendingChanges) markRemoved(filePath string) {
+	delete(p.updated, filePath)
 
-	// Define directories to ignore
-	ignorePatterns, err := readGitignore(directoryPath)
-	if err != nil {
-		return fmt.Errorf("error reading .gitignore: %v", err)
+	// A file moved twice in one batch is still a single move from its
+	// original location
+	if oldPath, ok := p.renamed[filePath]; ok {
+		delete(p.renamed, filePath)
+		filePath = oldPath
 	}
+	p.deleted[filePath] = true
+}
+
+func (p *pendingChanges) markRenamed(oldPath string, newPath string) {
+	if !p.deleted[oldPath] {
+		return
+	}
+	delete(p.deleted, oldPath)
+	p.renamed[newPath] = oldPath
+}
 
-	err = filepath.Walk(directoryPath, func(path string, info os.FileInfo, err error) error {
+// toFileChanges converts the pending local changes into remote paths
+func (p *pendingChanges) toFileChanges(root string) fileChanges {
+	var changes fileChanges
+
+	for _, filePath := range sortedKeys(p.deleted) {
+		if remotePath, err := remoteFilePath(root, filePath); err == nil {
+			changes.Deleted = append(changes.Deleted, remotePath)
+		}
+	}
+	for _, newPath := range sortedKeys(p.renamed) {
+		oldRemote, err := remoteFilePath(root, p.renamed[newPath])
 		if err != nil {
-			return err
+			continue
 		}
-		if info.IsDir() {
-			// Check if the directory should be ignored
-			if shouldIgnore(path, ignorePatterns) {
-				return filepath.SkipDir
-			}
+		newRemote, err := remoteFilePath(root, newPath)
+		if err != nil {
+			continue
+		}
+		changes.Renamed = append(changes.Renamed, FileRename{OldFilePath: oldRemote, NewFilePath: newRemote})
+	}
+	for _, filePath := range sortedKeys(p.updated) {
+		file := p.updated[filePath]
+		if remotePath, err := remoteFilePath(root, filePath); err == nil {
+			file.FilePath = remotePath
+			changes.Files = append(changes.Files, file)
+		}
+	}
+
+	return changes
+}
+
+// localPaths returns every local path touched by the pending changes
+func (p *pendingChanges) localPaths() []string {
+	var paths []string
+	for filePath := range p.updated {
+		paths = append(paths, filePath)
+	}
+	for filePath := range p.deleted {
+		paths = append(paths, filePath)
+	}
+	for newPath, oldPath := range p.renamed {
+		paths = append(paths, newPath, oldPath)
+	}
+	return paths
+}
+
+// debouncer batches watcher events. It belongs to the event loop of
+// watchDirectory: only that goroutine touches the pending changes and reads
+// the timer, so nothing is shared with an upload in flight.
+//
+// A batch is sent once no event has arrived for the quiet period, or once
+// its first change has waited maxWait so a file that is saved over and over
+// still gets synced, or straight away when it holds maxFiles changes or
+// maxBytes of updated files. Zero limits mean no limit.
+type debouncer struct {
+	quiet    time.Duration
+	maxWait  time.Duration
+	maxFiles int
+	maxBytes int64
+
+	pending *pendingChanges
+	// sizes holds the size of each updated file when it was last changed
+	sizes map[string]int64
+	// first is when the oldest change in pending arrived
+	first time.Time
+	timer *time.Timer
+}
+
+func newDebouncer(quiet, maxWait time.Duration, maxFiles int, maxBytes int64) *debouncer {
+	return &debouncer{
+		quiet:    quiet,
+		maxWait:  maxWait,
+		maxFiles: maxFiles,
+		maxBytes: maxBytes,
+		pending:  newPendingChanges(),
+		sizes:    make(map[string]int64),
+	}
+}
 
-			// fmt.Printf("Watching directory: %s\n", path)
-			_ = watcher.Add(path)
+// markUpdated records a write to a file of the given size
+func (d *debouncer) markUpdated(filePath string, size int64) {
+	d.pending.markUpdated(filePath)
+	d.sizes[filePath] = size
+}
+
+func (d *debouncer) markRemoved(filePath string) {
+	d.pending.markRemoved(filePath)
+	delete(d.sizes, filePath)
+}
+
+// full reports whether the batch has reached its file or byte limit
+func (d *debouncer) full() bool {
+	if d.maxFiles > 0 && len(d.pending.updated)+len(d.pending.deleted)+len(d.pending.renamed) >= d.maxFiles {
+		return true
+	}
+	if d.maxBytes > 0 {
+		var total int64
+		for _, size := range d.sizes {
+			total += size
 		}
+		return total >= d.maxBytes
+	}
+	return false
+}
+
+// touched restarts the quiet period after a change was added, without
+// holding the batch back past its max wait or once it is full
+func (d *debouncer) touched() {
+	now := time.Now()
+	if d.first.IsZero() {
+		d.first = now
+	}
+	wait := min(d.quiet, max(d.maxWait-now.Sub(d.first), 0))
+	if d.full() {
+		wait = 0
+	}
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.NewTimer(wait)
+}
+
+// ready delivers when the batch is due, and blocks while nothing is pending
+func (d *debouncer) ready() <-chan time.Time {
+	if d.timer == nil {
 		return nil
-	})
+	}
+	return d.timer.C
+}
+
+// take returns the pending changes and starts a new batch
+func (d *debouncer) take() *pendingChanges {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	batch := d.pending
+	d.pending = newPendingChanges()
+	d.sizes = make(map[string]int64)
+	d.first = time.Time{}
+	return batch
+}
+
+// watchDirectory uploads changes under directoryPath until ctx is
+// cancelled, and then returns ctx's error. Changes not yet sent stay in
+// the upload queue for the next run.
+func watchDirectory(ctx context.Context, directoryPath, workspaceId, repoName, repoId string, ignorePatterns []string) error {
+	watcher := newFileWatcher(config.watchMode, config.watchPollInterval)
+	defer watcher.close()
+
+	batch := newDebouncer(config.watchQuietPeriod, config.watchMaxWait, config.watchMaxFiles, config.watchMaxBytes)
+
+	// Changes left over from an earlier run are sent first
+	queue, err := openUploadQueue(ctx, directoryPath, workspaceId, repoName, repoId)
+	if err != nil {
+		return fmt.Errorf("error opening upload queue: %v", err)
+	}
+	defer queue.stop()
+	if queue.len() > 0 {
+		go queue.flush()
+	}
+
+	var lastRenamePath string
+	var lastRenameTime time.Time
+
+	// Define directories to ignore
+	matcher, err := newIgnoreMatcher(directoryPath, ignorePatterns)
 	if err != nil {
+		return fmt.Errorf("error reading ignore files: %v", err)
+	}
+
+	// Directories being watched, so a removed one can be recognised after
+	// it is gone
+	watched := make(map[string]bool)
+	if err := watchTree(watcher, matcher, watched, directoryPath, nil); err != nil {
 		return fmt.Errorf("error setting up recursive watch: %v", err)
 	}
+	polledReported := 0
+	warnPolledDirectories(watcher, config.watchPollInterval, &polledReported)
+
+	// A branch switch, checkout or rebase changes many files at once, so it
+	// is followed by one resync of the working tree against the manifest
+	// instead of an upload per file event
+	head, gitDir, followGit := readGitHead(directoryPath)
+	followGit = followGit && config.gitFollowBranches
+	if followGit {
+		if err := watchGitDir(watcher, gitDir); err != nil {
+			fmt.Printf("Warning: not following branch switches: %v\n", err)
+			followGit = false
+		}
+	}
+	resync := false
 
 	for {
 		select {
-		case event, ok := <-watcher.Events:
+		case <-ctx.Done():
+			queue.enqueue(batch.take())
+			fmt.Printf("\nStopped watching, %d changes are queued for the next run\n", queue.len())
+			return ctx.Err()
+		case <-batch.ready():
+			if !resync {
+				queue.enqueue(batch.take())
+				go queue.flush()
+				continue
+			}
+
+			resync = false
+			pending := batch.take()
+			// An upload from before the switch mustn't land after the resync
+			queue.pause()
+			err := resyncRepository(ctx, directoryPath, workspaceId, repoName, repoId, ignorePatterns, queue)
+			queue.resume()
+			if err != nil {
+				// The file events still say what changed
+				queue.enqueue(pending)
+				if ctx.Err() == nil {
+					fmt.Printf("Error resyncing after the git change, sending the changed files instead: %v\n", err)
+					go queue.flush()
+				}
+			}
+		case event, ok := <-watcher.events():
 			if !ok {
 				return fmt.Errorf("watcher channel closed")
 			}
-			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Chmod) != 0 {
-				// Check if file path must be ignored
-				filePath := event.Name
-				if shouldIgnore(filePath, ignorePatterns) {
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Chmod|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			filePath := event.Name
+			if followGit && (filePath == gitDir || isWithin(gitDir, filePath)) {
+				if !isGitRefPath(gitDir, filePath) {
 					continue
 				}
+				// Branches with slashes in their names live in directories
+				if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+					watcher.add(filePath)
+				}
 
-				// Check if the file extension is allowed
-				fileExtension := filepath.Ext(filePath)
-				if !contains(supportedFileTypes, fileExtension) {
+				current, _, ok := readGitHead(directoryPath)
+				if !ok || current == head {
 					continue
 				}
+				head = current
+				activeGitHead.Store(&current)
+				if !resync {
+					fmt.Printf("Moved to %s, syncing once the working tree settles...\n", current)
+				}
+				resync = true
+				batch.touched()
+				continue
+			}
 
-				// Check if file is already in filesToUpdate
-				fileRepeated := false
-				for _, file := range filesToUpdate {
-					if file.FilePath == filePath {
-						fileRepeated = true
-						break
-					}
+			// Pick up edits to .gitignore files straight away
+			if isIgnoreFile(filePath) {
+				if updated, err := matcher.reload(); err == nil {
+					matcher = updated
+				} else {
+					fmt.Printf("Error reloading ignore files: %v\n", err)
 				}
+				continue
+			}
 
-				if !fileRepeated {
-					content, err := readFile(filePath)
-					if err != nil {
-						fmt.Printf("Error reading file %s: %v\n", filePath, err)
-						continue
-					}
+			// Directories are checked before the file type, which they
+			// don't have
+			isDir := false
+			var size int64
+			if info, err := os.Stat(filePath); err == nil {
+				isDir = info.IsDir()
+				size = info.Size()
+			}
+			wasDir := watched[filePath]
+			if matcher.ignored(filePath, isDir || wasDir) {
+				continue
+			}
 
-					filesToUpdate = append(filesToUpdate, FileContent{
-						FilePath:      filePath,
-						FileExtension: fileExtension,
-						DataChunks:    content,
-					})
+			switch {
+			case isDir:
+				if event.Op&fsnotify.Create == 0 || wasDir {
+					continue
 				}
 
-				// If a new directory is created, add it to the watcher
-				if info, err := os.Stat(filePath); err == nil && info.IsDir() {
-					if !shouldIgnore(filePath, ignorePatterns) {
-						err = watcher.Add(filePath)
-						if err != nil {
-							fmt.Printf("Error watching new directory %s: %v\n", filePath, err)
-						} else {
-							fmt.Printf("New directory added to watch: %s\n", filePath)
+				// A directory created or moved in may already hold files
+				// and directories of its own, such as after git checkout
+				// or unzip, which never get events of their own
+				if hasIgnoreFile(filePath) {
+					if updated, err := matcher.reload(); err == nil {
+						matcher = updated
+					}
+				}
+				movedFrom := ""
+				if lastRenamePath != "" && time.Since(lastRenameTime) < renamePairWindow {
+					movedFrom = lastRenamePath
+					lastRenamePath = ""
+				}
+				err := watchTree(watcher, matcher, watched, filePath, func(path string, info os.FileInfo) {
+					if !config.fileTypes.matches(path) {
+						return
+					}
+					if movedFrom != "" {
+						if rel, err := filepath.Rel(filePath, path); err == nil {
+							batch.pending.markRenamed(filepath.Join(movedFrom, rel), path)
 						}
 					}
+					batch.markUpdated(path, info.Size())
+				})
+				if err != nil {
+					fmt.Printf("Error watching new directory %s: %v\n", filePath, err)
+				} else {
+					fmt.Printf("New directory added to watch: %s\n", filePath)
 				}
+				warnPolledDirectories(watcher, config.watchPollInterval, &polledReported)
 
-				if timeoutTimer != nil {
-					timeoutTimer.Stop()
+			case wasDir:
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+					continue
 				}
 
-				timeoutTimer = time.AfterFunc(5*time.Second, func() {
-					processUpdatedFiles(filesToUpdate, token, workspaceId, repoId, repoName)
-					filesToUpdate = make([]FileContent, 0)
-				})
+				// Everything under a removed or moved-out directory is gone,
+				// even where no event arrived for it
+				unwatchTree(watcher, watched, filePath)
+				for _, removed := range filesUnder(directoryPath, workspaceId, batch.pending, filePath) {
+					batch.markRemoved(removed)
+				}
+				if event.Op&fsnotify.Rename != 0 {
+					lastRenamePath = filePath
+					lastRenameTime = time.Now()
+				}
+
+			case !config.fileTypes.matches(filePath):
+				// Check if the file type is allowed
+				continue
+
+			case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				batch.markRemoved(filePath)
+				if event.Op&fsnotify.Rename != 0 {
+					lastRenamePath = filePath
+					lastRenameTime = time.Now()
+				}
+
+			default:
+				// A create straight after a rename is the new name of the
+				// same file
+				if event.Op&fsnotify.Create != 0 && lastRenamePath != "" && time.Since(lastRenameTime) < renamePairWindow {
+					if lastRenamePath != filePath {
+						batch.pending.markRenamed(lastRenamePath, filePath)
+					}
+					lastRenamePath = ""
+				}
+				batch.markUpdated(filePath, size)
 			}
-		case err, ok := <-watcher.Errors:
+
+			batch.touched()
+		case err, ok := <-watcher.errors():
 			if !ok {
 				return fmt.Errorf("watcher error channel closed")
 			}
@@ -127,79 +437,165 @@ func watchDirectory(directoryPath, workspaceId, repoName, repoId, token string)
 	}
 }
 
-func readGitignore(dirPath string) ([]string, error) {
-	gitignorePath := filepath.Join(dirPath, ".gitignore")
-	ignorePatterns := []string{".git", "node_modules", "package-lock.json"}
-
-	if _, err := os.Stat(gitignorePath); err == nil {
-		file, err := os.Open(gitignorePath)
+// watchTree adds dir and every directory below it that isn't ignored to
+// watcher, and calls found for each file that isn't ignored. Directories
+// that can't be watched at all are skipped with a warning.
+func watchTree(watcher fileWatcher, matcher *ignoreMatcher, watched map[string]bool, dir string, found func(path string, info os.FileInfo)) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return nil, fmt.Errorf("error opening .gitignore: %v", err)
+			// Removed while walking, which a later event reports
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
 		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			pattern := strings.TrimSpace(scanner.Text())
-			if pattern != "" && !strings.HasPrefix(pattern, "#") {
-				ignorePatterns = append(ignorePatterns, pattern)
+		if matcher.ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
 		}
-	}
 
-	return ignorePatterns, nil
+		if info.IsDir() {
+			if err := watcher.add(path); err != nil {
+				fmt.Printf("Warning: not watching %s for changes: %v\n", path, err)
+				return filepath.SkipDir
+			}
+			watched[path] = true
+		} else if found != nil {
+			found(path, info)
+		}
+		return nil
+	})
 }
 
-func shouldIgnore(path string, ignorePatterns []string) bool {
-	for _, pattern := range ignorePatterns {
-		matched, err := filepath.Match(pattern, filepath.Base(path))
-		if err == nil && matched {
-			return true
-		}
-		if strings.HasPrefix(pattern, "/") {
-			if strings.HasPrefix(path, filepath.Clean(pattern)) {
-				return true
-			}
-		} else {
-			if strings.Contains(path, string(filepath.Separator)+pattern+string(filepath.Separator)) {
-				return true
-			}
+// unwatchTree stops watching dir and every directory below it
+func unwatchTree(watcher fileWatcher, watched map[string]bool, dir string) {
+	for path := range watched {
+		if path == dir || isWithin(dir, path) {
+			// The watch of a deleted directory is already gone
+			_ = watcher.remove(path)
+			delete(watched, path)
 		}
 	}
-	return false
 }
 
-// Helper function to check if a directory should be ignored
-func containsDir(slice []string, item string) bool {
-	for _, s := range slice {
-		if s == item {
-			return true
+// filesUnder returns the files under dir that the server or the pending
+// batch knows about, for when dir has been removed
+func filesUnder(root, workspaceId string, pending *pendingChanges, dir string) []string {
+	var files []string
+	for filePath := range pending.updated {
+		if isWithin(dir, filePath) {
+			files = append(files, filePath)
 		}
 	}
-	return false
+
+	manifest, err := loadManifest(root, workspaceId)
+	if err != nil {
+		return files
+	}
+	remoteDir, err := remoteFilePath(root, dir)
+	if err != nil {
+		return files
+	}
+	for remotePath := range manifest.Files {
+		if !isWithin(remoteDir, remotePath) {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Base(root), remotePath)
+		if err == nil {
+			files = append(files, filepath.Join(root, rel))
+		}
+	}
+	return files
 }
 
-// Helper function to check if a file is in an ignored directory
-func isInIgnoredDir(filePath string, ignoreDirs []string) bool {
-	parts := strings.Split(filePath, string(os.PathSeparator))
-	for _, part := range parts {
-		if containsDir(ignoreDirs, part) {
-			return true
+// hasIgnoreFile reports whether there is an ignore file anywhere under dir
+func hasIgnoreFile(dir string) bool {
+	found := false
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && isIgnoreFile(path) {
+			found = true
+			return filepath.SkipAll
 		}
+		return nil
+	})
+	return found
+}
+
+// isWithin reports whether path is below dir
+func isWithin(dir, path string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// resyncRepository brings the server up to date with the whole working
+// tree in one diff against the manifest, which covers everything queued.
+// The queue must be paused, so it is cleared before it can upload again.
+func resyncRepository(ctx context.Context, directoryPath, workspaceId, repoName, repoId string, ignorePatterns []string, queue *uploadQueue) error {
+	files, err := readDir(directoryPath, ignorePatterns)
+	if err != nil {
+		return fmt.Errorf("error reading directory: %v", err)
 	}
-	return false
+	result, err := syncRepository(ctx, directoryPath, files, workspaceId, repoName, repoId, false)
+	if err != nil {
+		return err
+	}
+	queue.clear()
+
+	printSkippedFiles(result.Skipped)
+	fmt.Printf("\033[1;32m✓ Uploaded %d changed, renamed %d and removed %d files\033[0m\n", result.Uploaded, result.Renamed, result.Deleted)
+	return nil
 }
 
-// Helper function to check if a slice contains a string
+func processUpdatedFiles(ctx context.Context, directoryPath string, pending *pendingChanges, workspaceId string, repoId string, repoName string) error {
+	changes := pending.toFileChanges(directoryPath)
+
+	// Files with credentials in them are removed remotely rather than left
+	// at their last clean version
+	var blocked []skippedFile
+	changes.Files, blocked = newSecretScanner(config).filter(changes.Files)
+	printSkippedFiles(blocked)
+	blockedPaths := make(map[string]bool)
+	for _, file := range blocked {
+		blockedPaths[file.Path] = true
+		changes.Deleted = append(changes.Deleted, file.Path)
+	}
+
+	if changes.isEmpty() {
+		return nil
+	}
 
-func processUpdatedFiles(filesToUpdate []FileContent, token, workspaceId string, repoId string, repoName string) {
 	err := showLoadingAnimation("Updating files...", func() error {
-		_, err := sendDataToServer(filesToUpdate, token, workspaceId, repoName, repoId, true)
+		_, err := sendDataToServer(ctx, changes, workspaceId, repoName, repoId, true)
 		return err
 	})
 
 	if err != nil {
-		fmt.Printf("Error processing files: %v\n", err)
-		return
+		return fmt.Errorf("error processing files: %w", err)
+	}
+
+	// Keep the manifest current so the next link only sends what changed
+	// while mordecai wasn't running
+	manifest, err := loadManifest(directoryPath, workspaceId)
+	if err != nil || manifest.ContextId != repoId {
+		return nil
+	}
+	var recorded []string
+	for _, filePath := range pending.localPaths() {
+		remotePath, err := remoteFilePath(directoryPath, filePath)
+		if err != nil || blockedPaths[remotePath] {
+			continue
+		}
+		// Skipped files are left out so the next link reconsiders them
+		if pending.skipped[filePath] {
+			delete(manifest.Files, remotePath)
+			continue
+		}
+		recorded = append(recorded, filePath)
+	}
+	manifest.record(recorded, pending.sent)
+	if err := manifest.save(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
 	}
+	return nil
 }
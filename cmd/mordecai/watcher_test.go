@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPendingChanges(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "work", "repo")
+	local := func(name string) string { return filepath.Join(root, name) }
+	remote := func(name string) string { return filepath.Join("repo", name) }
+
+	pending := newPendingChanges()
+
+	// Edited then deleted within one batch: only the delete survives
+	pending.updated[local("gone.go")] = FileContent{FilePath: local("gone.go")}
+	pending.markRemoved(local("gone.go"))
+
+	// Moved twice: a single rename from the original path
+	pending.markRemoved(local("a.go"))
+	pending.markRenamed(local("a.go"), local("b.go"))
+	pending.markRemoved(local("b.go"))
+	pending.markRenamed(local("a.go"), local("c.go"))
+
+	pending.updated[local("c.go")] = FileContent{FilePath: local("c.go"), FileExtension: ".go"}
+
+	changes := pending.toFileChanges(root)
+
+	if len(changes.Deleted) != 1 || changes.Deleted[0] != remote("gone.go") {
+		t.Errorf("Deleted = %v, want [%v]", changes.Deleted, remote("gone.go"))
+	}
+
+	if len(changes.Renamed) != 1 {
+		t.Fatalf("Renamed = %v, want one rename", changes.Renamed)
+	}
+	if changes.Renamed[0].OldFilePath != remote("a.go") || changes.Renamed[0].NewFilePath != remote("c.go") {
+		t.Errorf("Renamed = %+v, want %v -> %v", changes.Renamed[0], remote("a.go"), remote("c.go"))
+	}
+
+	if len(changes.Files) != 1 || changes.Files[0].FilePath != remote("c.go") {
+		t.Errorf("Files = %v, want [%v]", changes.Files, remote("c.go"))
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	batch := newDebouncer(50*time.Millisecond, 200*time.Millisecond, 0, 0)
+	if batch.ready() != nil {
+		t.Fatal("ready() should block while nothing is pending")
+	}
+
+	// Events closer together than the quiet period keep the batch open
+	batch.markUpdated("a.go", 10)
+	batch.touched()
+	time.Sleep(30 * time.Millisecond)
+	batch.markUpdated("b.go", 10)
+	batch.touched()
+	select {
+	case <-batch.ready():
+		t.Fatal("batch was due before the quiet period after the last event")
+	case <-time.After(30 * time.Millisecond):
+	}
+	<-batch.ready()
+
+	if pending := batch.take(); len(pending.updated) != 2 {
+		t.Errorf("take() = %v, want both files", pending.updated)
+	}
+	if len(batch.pending.updated) != 0 || batch.ready() != nil {
+		t.Error("take() should start an empty batch")
+	}
+
+	// A file saved more often than the quiet period is still sent once the
+	// batch reaches its max wait
+	start := time.Now()
+	for {
+		batch.markUpdated("busy.go", 10)
+		batch.touched()
+		select {
+		case <-batch.ready():
+			if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+				t.Errorf("batch was due after %v, want the max wait of 200ms", elapsed)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// watchedUpload is a request the watcher sent to the test server
+type watchedUpload struct {
+	Files        []FileContent `json:"files"`
+	DeletedFiles []string      `json:"deletedFiles"`
+	RenamedFiles []FileRename  `json:"renamedFiles"`
+	Branch       string        `json:"branch"`
+	Commit       string        `json:"commit"`
+}
+
+// startWatcher runs watchDirectory on a new directory against a test
+// server, finding changes the way mode says, with a manifest so removals
+// of synced files can be seen. setup, if given, prepares the directory
+// before the watcher starts. It returns the directory and a function that
+// waits for the given number of uploads and returns every upload so far.
+func startWatcher(t *testing.T, mode string, setup func(root string)) (string, func(count int) []watchedUpload) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	useToken(t, "token", nil)
+	previousConfig, previousAPIURL := config, apiURLFlag
+	t.Cleanup(func() { config, apiURLFlag = previousConfig, previousAPIURL })
+	config = defaultConfig()
+	config.watchQuietPeriod, config.watchMaxWait = 100*time.Millisecond, time.Second
+	config.watchMode, config.watchPollInterval = mode, 20*time.Millisecond
+
+	var mu sync.Mutex
+	var uploads []watchedUpload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upload watchedUpload
+		json.NewDecoder(r.Body).Decode(&upload)
+		mu.Lock()
+		uploads = append(uploads, upload)
+		mu.Unlock()
+		w.Write([]byte(`{"contextId":"ctx-1"}`))
+	}))
+	t.Cleanup(server.Close)
+	apiURLFlag = server.URL
+
+	root := t.TempDir()
+	manifest, err := loadManifest(root, "space-1")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %v", err)
+	}
+	manifest.ContextId = "ctx-1"
+	if err := manifest.save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+	if setup != nil {
+		setup(root)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watchDirectory(ctx, root, "space-1", "repo", "ctx-1", nil) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("watchDirectory() = %v after cancelling, want context.Canceled", err)
+		}
+	})
+	// Give the watcher time to register the directory
+	time.Sleep(200 * time.Millisecond)
+
+	return root, func(count int) []watchedUpload {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			got := append([]watchedUpload(nil), uploads...)
+			mu.Unlock()
+			if len(got) >= count || time.Now().After(deadline) {
+				// Nothing else should follow the batches waited for
+				time.Sleep(300 * time.Millisecond)
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]watchedUpload(nil), uploads...)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestWatchDirectoryUploadsLatestContent(t *testing.T) {
+	for _, mode := range []string{watchModeAuto, watchModePoll} {
+		t.Run(mode, func(t *testing.T) {
+			root, waitForUploads := startWatcher(t, mode, nil)
+
+			// Saved twice within the quiet period: one upload with the
+			// second save
+			filePath := filepath.Join(root, "main.go")
+			for _, content := range []string{"package main // first", "package main // second"} {
+				if err := os.WriteFile(filePath, []byte(content), 0666); err != nil {
+					t.Fatalf("Failed to write test file: %v", err)
+				}
+				time.Sleep(30 * time.Millisecond)
+			}
+
+			uploads := waitForUploads(1)
+			if len(uploads) != 1 || len(uploads[0].Files) != 1 || uploads[0].Files[0].DataChunks != "package main // second" {
+				t.Errorf("uploads = %+v, want a single upload of the second save", uploads)
+			}
+		})
+	}
+}
+
+func TestWatchDirectoryNewDirectories(t *testing.T) {
+	root, waitForUploads := startWatcher(t, watchModeAuto, nil)
+	remote := func(name string) string { return filepath.Join(filepath.Base(root), name) }
+
+	// A tree moved in already holds files and a nested directory
+	outside := filepath.Join(t.TempDir(), "pkg")
+	for _, name := range []string{"a.go", filepath.Join("sub", "b.go"), "notes.bin"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(outside, name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(outside, name), []byte("package pkg"), 0666); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+	pkgDir := filepath.Join(root, "pkg")
+	if err := os.Rename(outside, pkgDir); err != nil {
+		t.Fatalf("Failed to move directory in: %v", err)
+	}
+
+	uploads := waitForUploads(1)
+	if len(uploads) != 1 || len(uploads[0].Files) != 2 || uploads[0].Files[0].FilePath != remote("pkg/a.go") || uploads[0].Files[1].FilePath != remote("pkg/sub/b.go") {
+		t.Fatalf("uploads = %+v, want the two Go files of the moved-in tree", uploads)
+	}
+
+	// The nested directory is watched too
+	if err := os.WriteFile(filepath.Join(pkgDir, "sub", "c.go"), []byte("package sub"), 0666); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	uploads = waitForUploads(2)
+	if len(uploads) != 2 || len(uploads[1].Files) != 1 || uploads[1].Files[0].FilePath != remote("pkg/sub/c.go") {
+		t.Fatalf("uploads = %+v, want the file created in the nested directory", uploads)
+	}
+
+	// Moving the tree out removes every synced file under it
+	if err := os.Rename(pkgDir, filepath.Join(t.TempDir(), "pkg")); err != nil {
+		t.Fatalf("Failed to move directory out: %v", err)
+	}
+	uploads = waitForUploads(3)
+	if len(uploads) != 3 {
+		t.Fatalf("uploads = %+v, want the removal of the moved-out tree", uploads)
+	}
+	deleted := uploads[2].DeletedFiles
+	want := []string{remote("pkg/a.go"), remote("pkg/sub/b.go"), remote("pkg/sub/c.go")}
+	if len(deleted) != len(want) || deleted[0] != want[0] || deleted[1] != want[1] || deleted[2] != want[2] {
+		t.Errorf("DeletedFiles = %v, want %v", deleted, want)
+	}
+}
+
+func TestDebouncerLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFiles int
+		maxBytes int64
+	}{
+		{name: "Max files", maxFiles: 2},
+		{name: "Max bytes", maxBytes: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch := newDebouncer(time.Minute, time.Hour, tt.maxFiles, tt.maxBytes)
+			batch.markUpdated("a.go", 60)
+			batch.touched()
+			select {
+			case <-batch.ready():
+				t.Fatal("batch was due before reaching its limit")
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			batch.markUpdated("b.go", 60)
+			batch.touched()
+			select {
+			case <-batch.ready():
+			case <-time.After(time.Second):
+				t.Fatal("batch wasn't sent straight away when it reached its limit")
+			}
+		})
+	}
+}
+
+func TestWatchDirectoryFollowsBranchSwitches(t *testing.T) {
+	var repo *git.Repository
+	commits := make(map[string]string)
+	root, waitForUploads := startWatcher(t, watchModeAuto, func(root string) {
+		var err error
+		repo, err = git.PlainInit(root, false)
+		if err != nil {
+			t.Fatalf("PlainInit() error = %v", err)
+		}
+		worktree, err := repo.Worktree()
+		if err != nil {
+			t.Fatalf("Worktree() error = %v", err)
+		}
+		commit := func(branch string, files map[string]string) {
+			for name, content := range files {
+				if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0666); err != nil {
+					t.Fatalf("Failed to write test file: %v", err)
+				}
+				if _, err := worktree.Add(name); err != nil {
+					t.Fatalf("Add() error = %v", err)
+				}
+			}
+			hash, err := worktree.Commit("Commit to "+branch, &git.CommitOptions{
+				Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+			})
+			if err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			commits[branch] = hash.String()
+		}
+
+		commit("master", map[string]string{"a.go": "package a // master"})
+		if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature"), Create: true}); err != nil {
+			t.Fatalf("Checkout() error = %v", err)
+		}
+		commit("feature", map[string]string{"a.go": "package a // feature", "b.go": "package b"})
+		if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("master")}); err != nil {
+			t.Fatalf("Checkout() error = %v", err)
+		}
+
+		// The server already has master
+		manifest, err := loadManifest(root, "space-1")
+		if err != nil {
+			t.Fatalf("loadManifest() error = %v", err)
+		}
+		recordFromDisk(t, manifest, filepath.Join(root, "a.go"))
+		if err := manifest.save(); err != nil {
+			t.Fatalf("save() error = %v", err)
+		}
+	})
+	remote := func(name string) string { return filepath.Join(filepath.Base(root), name) }
+	checkout := func(branch string) {
+		worktree, err := repo.Worktree()
+		if err != nil {
+			t.Fatalf("Worktree() error = %v", err)
+		}
+		if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch)}); err != nil {
+			t.Fatalf("Checkout() error = %v", err)
+		}
+	}
+
+	// One upload of the new tree, tagged with the branch
+	checkout("feature")
+	uploads := waitForUploads(1)
+	if len(uploads) != 1 {
+		t.Fatalf("uploads = %+v, want one resync", uploads)
+	}
+	upload := uploads[0]
+	if len(upload.Files) != 2 || upload.Files[0].FilePath != remote("a.go") || upload.Files[0].DataChunks != "package a // feature" || upload.Files[1].FilePath != remote("b.go") {
+		t.Errorf("Files = %+v, want a.go from feature and the new b.go", upload.Files)
+	}
+	if upload.Branch != "feature" || upload.Commit != commits["feature"] {
+		t.Errorf("upload tagged %s at %s, want feature at %s", upload.Branch, upload.Commit, commits["feature"])
+	}
+
+	// Switching back removes the file only feature has
+	checkout("master")
+	uploads = waitForUploads(2)
+	if len(uploads) != 2 {
+		t.Fatalf("uploads = %+v, want a second resync", uploads)
+	}
+	upload = uploads[1]
+	if len(upload.Files) != 1 || upload.Files[0].DataChunks != "package a // master" {
+		t.Errorf("Files = %+v, want a.go from master", upload.Files)
+	}
+	if len(upload.DeletedFiles) != 1 || upload.DeletedFiles[0] != remote("b.go") {
+		t.Errorf("DeletedFiles = %v, want b.go", upload.DeletedFiles)
+	}
+	if upload.Branch != "master" || upload.Commit != commits["master"] {
+		t.Errorf("upload tagged %s at %s, want master at %s", upload.Branch, upload.Commit, commits["master"])
+	}
+}